@@ -0,0 +1,397 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// BadgerStore is a Store backed by a badger.DB.
+type BadgerStore struct {
+	db *badger.DB
+}
+
+func NewBadgerStore(db *badger.DB) *BadgerStore {
+	return &BadgerStore{db: db}
+}
+
+func (s *BadgerStore) Put(entry StoreEntry) (bool, error) {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return put(txn, entry)
+	})
+	if err == ErrDuplicate {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// PutBatch commits entries in as few transactions as possible, starting a
+// new one whenever badger reports the current one is too big.
+func (s *BadgerStore) PutBatch(entries []StoreEntry) []error {
+	errs := make([]error, len(entries))
+	txn := s.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	start := 0
+	for i := 0; i < len(entries); i++ {
+		err := put(txn, entries[i])
+		if err != badger.ErrTxnTooBig {
+			errs[i] = err
+			continue
+		}
+
+		//the entry may be half written, so drop the transaction and replay
+		//the entries that fitted before committing them
+		txn.Discard()
+		txn = s.db.NewTransaction(true)
+		if i == start {
+			errs[i] = err
+			start = i + 1
+			continue
+		}
+		for j := start; j < i; j++ {
+			errs[j] = put(txn, entries[j])
+		}
+		s.commit(txn, errs[start:i])
+		txn = s.db.NewTransaction(true)
+		start = i
+		i--
+	}
+	s.commit(txn, errs[start:])
+
+	return errs
+}
+
+// commit commits txn and, if that fails, reports the error for every entry
+// written in it.
+func (s *BadgerStore) commit(txn *badger.Txn, errs []error) {
+	if err := txn.Commit(); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+}
+
+// put applies entry inside txn. ErrDuplicate is returned without writing
+// anything when the dedupe marker matches.
+func put(txn *badger.Txn, entry StoreEntry) error {
+	//Dedupe Block
+	dedupeKey := []byte(entry.DedupeKey)
+	var marker []byte
+	if entry.UniqueID != "" {
+		var existingMarker []byte
+		if existingItem, _ := txn.Get(dedupeKey); existingItem != nil {
+			existingMarker, _ = existingItem.ValueCopy(existingMarker)
+		}
+		var duplicate bool
+		if marker, duplicate = dedupeMarker(existingMarker, entry.UniqueID, entry.DedupeWindow); duplicate {
+			//value match skipping store for dedupe
+			return ErrDuplicate
+		}
+	}
+
+	value := entry.Value
+	if entry.Merge != nil {
+		existingItem, err := txn.Get([]byte(entry.Key))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if existingItem != nil {
+			var existing []byte
+			if existing, err = existingItem.ValueCopy(existing); err != nil {
+				return err
+			}
+			if value, err = entry.Merge(existing); err != nil {
+				return err
+			}
+		}
+	}
+
+	if entry.UniqueID != "" {
+		dupeEntry := badger.NewEntry(dedupeKey, marker)
+		if entry.DedupeTTL > 0 {
+			dupeEntry.WithTTL(entry.DedupeTTL)
+		}
+		if err := txn.SetEntry(dupeEntry); err != nil {
+			return err
+		}
+	}
+
+	e := badger.NewEntry([]byte(entry.Key), value)
+	if entry.TTL > 0 {
+		e.WithTTL(entry.TTL)
+	}
+	return txn.SetEntry(e)
+}
+
+func (s *BadgerStore) GetAndDelete(key string) ([]byte, error) {
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	value, err := getAndDelete(txn, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// GetAndDeleteBatch commits the deletes in as few transactions as possible,
+// starting a new one whenever badger reports the current one is too big.
+func (s *BadgerStore) GetAndDeleteBatch(keys []string) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	txn := s.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	start := 0
+	for i := 0; i < len(keys); i++ {
+		value, err := getAndDelete(txn, keys[i])
+		if err == badger.ErrTxnTooBig && i > start {
+			//nothing was written for keys[i], so retry it in a new transaction
+			s.commitDeletes(txn, values[start:i], errs[start:i])
+			txn = s.db.NewTransaction(true)
+			start = i
+			i--
+			continue
+		}
+		values[i], errs[i] = value, err
+	}
+	s.commitDeletes(txn, values[start:], errs[start:])
+
+	return values, errs
+}
+
+// commitDeletes commits txn and, if that fails, reports the error for every
+// value read in it.
+func (s *BadgerStore) commitDeletes(txn *badger.Txn, values [][]byte, errs []error) {
+	if err := txn.Commit(); err != nil {
+		for i := range values {
+			if errs[i] == nil {
+				values[i], errs[i] = nil, err
+			}
+		}
+	}
+}
+
+func getAndDelete(txn *badger.Txn, key string) ([]byte, error) {
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := txn.Delete([]byte(key)); err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	return item.ValueCopy(value)
+}
+
+func (s *BadgerStore) Update(key string, fn func(existing []byte) ([]byte, error)) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var existing []byte
+		if existing, err = item.ValueCopy(existing); err != nil {
+			return err
+		}
+		value, err := fn(existing)
+		if err != nil {
+			return err
+		}
+
+		e := badger.NewEntry([]byte(key), value)
+		e.ExpiresAt = item.ExpiresAt()
+		return txn.SetEntry(e)
+	})
+}
+
+func (s *BadgerStore) Exists(keys []string) ([]bool, error) {
+	exists := make([]bool, len(keys))
+	err := s.db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			_, err := txn.Get([]byte(key))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			exists[i] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+func (s *BadgerStore) Delete(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (s *BadgerStore) DeleteIf(key string, fn func(existing []byte) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := item.Value(fn); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (s *BadgerStore) Move(from, to string, fn func(existing []byte) ([]byte, error)) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(from))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var existing []byte
+		if existing, err = item.ValueCopy(existing); err != nil {
+			return err
+		}
+		value, err := fn(existing)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Delete([]byte(from)); err != nil {
+			return err
+		}
+		return txn.Set([]byte(to), value)
+	})
+}
+
+func (s *BadgerStore) PutFrom(from string, fn func(existing []byte) (StoreEntry, error)) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(from))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var existing []byte
+		if existing, err = item.ValueCopy(existing); err != nil {
+			return err
+		}
+		entry, err := fn(existing)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Delete([]byte(from)); err != nil {
+			return err
+		}
+		return put(txn, entry)
+	})
+}
+
+func (s *BadgerStore) Rename(from, to string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(from))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+		if value, err = item.ValueCopy(value); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(from)); err != nil {
+			return err
+		}
+
+		e := badger.NewEntry([]byte(to), value)
+		e.ExpiresAt = item.ExpiresAt()
+		return txn.SetEntry(e)
+	})
+}
+
+func (s *BadgerStore) ScanAll(fn func(key string, value []byte) error) error {
+	return s.ScanPrefix("", fn)
+}
+
+func (s *BadgerStore) ScanPrefix(prefix string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			err := item.Value(func(v []byte) error {
+				return fn(string(k), v)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
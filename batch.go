@@ -0,0 +1,158 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"context"
+	"time"
+)
+
+// StoreStatus is the outcome of storing a single item.
+type StoreStatus int
+
+const (
+	// Stored means the item was written to the queue under a new key.
+	Stored StoreStatus = iota
+	// Deduplicated means the item was dropped because its UniqueID matched.
+	Deduplicated
+	// Rejected means the item was not written, see StoreResult.Err.
+	Rejected
+	// Compacted means the item was written into a key that was already
+	// buffered.
+	Compacted
+)
+
+type StoreResult struct {
+	Status StoreStatus
+	Err    error // why a Rejected item was not written
+}
+
+// StoreBatch stores items with as few store transactions as possible. The
+// same capacity, dedupe and merge rules as StoreToQueue apply to each
+// item, and the outcome for items[i] is reported in the i-th result.
+func (b *BufferCompactor) StoreBatch(items []StorageItem) []StoreResult {
+	return b.StoreBatchCtx(context.Background(), items)
+}
+
+// StoreBatchCtx is StoreBatch that rejects every item if ctx is done before they are written
+func (b *BufferCompactor) StoreBatchCtx(ctx context.Context, items []StorageItem) []StoreResult {
+	results := make([]StoreResult, len(items))
+	if err := ctx.Err(); err != nil {
+		for i := range results {
+			results[i] = StoreResult{Status: Rejected, Err: err}
+		}
+		return results
+	}
+
+	//each accepted item reserves its room, so later items see it taken
+	b.mu.Lock()
+	accepted := make([]int, 0, len(items))
+	reservations := make([]reservation, 0, len(items))
+	for i, item := range items {
+		//the batch is never blocked on, so OverflowBlock rejects like OverflowReject
+		res, err := b.tryAdmit(item.Key, int64(len(item.Value)))
+		if err != nil {
+			results[i] = StoreResult{Status: Rejected, Err: err}
+			continue
+		}
+		accepted = append(accepted, i)
+		reservations = append(reservations, res)
+	}
+	b.mu.Unlock()
+
+	//ids are resolved once, on a copy so the caller's items are left alone
+	items = append([]StorageItem(nil), items...)
+	for _, i := range accepted {
+		items[i].UniqueID = b.uniqueID(items[i])
+	}
+
+	now := time.Now()
+	if b.filter != nil {
+		accepted = b.filterBatch(items, accepted, results, now)
+	}
+
+	recs := make([]record, len(accepted))
+	entries := make([]StoreEntry, len(accepted))
+	for j, i := range accepted {
+		entries[j] = b.storeEntry(items[i], &recs[j], now)
+	}
+	errs := b.store.PutBatch(entries)
+
+	var stored, failed []string
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, res := range reservations {
+		b.release(res)
+	}
+	for j, i := range accepted {
+		switch errs[j] {
+		case nil:
+			results[i] = StoreResult{Status: recs[j].status()}
+			b.buffer(items[i].Key, recs[j])
+		case ErrDuplicate:
+			results[i] = StoreResult{Status: Deduplicated}
+		default:
+			results[i] = StoreResult{Status: Rejected, Err: errs[j]}
+		}
+		if id := items[i].UniqueID; b.filter != nil && id != "" {
+			if errs[j] == nil {
+				stored = append(stored, id)
+			} else {
+				failed = append(failed, id)
+			}
+		}
+	}
+	if b.filter != nil {
+		b.finishUniqueIDs(true, stored...)
+		b.finishUniqueIDs(false, failed...)
+	}
+	return results
+}
+
+// filterBatch drops the accepted items whose resolved UniqueID the dedupe
+// filter has seen, including ids claimed earlier in the batch, and returns
+// the rest, whose ids are now claimed.
+func (b *BufferCompactor) filterBatch(items []StorageItem, accepted []int, results []StoreResult, now time.Time) []int {
+	filtered := accepted[:0]
+	for _, i := range accepted {
+		id := items[i].UniqueID
+		if id == "" {
+			filtered = append(filtered, i)
+			continue
+		}
+
+		if b.claimUniqueID(id, now) {
+			results[i] = StoreResult{Status: Deduplicated}
+			continue
+		}
+		filtered = append(filtered, i)
+	}
+	return filtered
+}
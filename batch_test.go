@@ -0,0 +1,66 @@
+package buffercompact
+
+import (
+	"fmt"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StoreBatch(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithMaxValueCount(3), WithMergeFunc(func(key string, old, new []byte) ([]byte, error) {
+		return append(append(old, ','), new...), nil
+	}))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("a"), UniqueID: "id1"})
+
+	results := buffcomp.StoreBatch([]StorageItem{
+		{Key: "test1", Value: []byte("b"), UniqueID: "id1"},
+		{Key: "test1", Value: []byte("c"), UniqueID: "id2"},
+		{Key: "test2", Value: []byte("d")},
+		{Key: "test2", Value: []byte("e")},
+		{Key: "test3", Value: []byte("f")},
+		{Key: "test4", Value: []byte("g")},
+	})
+	assert.Equal(t, []StoreResult{
+		{Status: Deduplicated},
+		{Status: Compacted},
+		{Status: Stored},
+		{Status: Compacted},
+		{Status: Stored},
+		{Status: Rejected, Err: ErrMaxValueCount},
+	}, results)
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 3)
+	assert.Equal(t, []byte("a,c"), items[0].Value)
+	assert.Equal(t, []byte("d,e"), items[1].Value)
+	assert.Equal(t, []byte("f"), items[2].Value)
+}
+
+func Test_StoreBatch_SplitsLargeTransactions(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithMemTableSize(1 << 20).WithValueThreshold(1 << 10).WithLogger(nil))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	buffcomp, err := New(db, 0)
+	assert.Nil(t, err)
+
+	//1000 * 900B does not fit in a single transaction with a 1MB memtable
+	items := make([]StorageItem, 1000)
+	for i := range items {
+		items[i] = StorageItem{Key: fmt.Sprintf("test%04d", i), Value: make([]byte, 900), UniqueID: "id"}
+	}
+
+	results := buffcomp.StoreBatch(items)
+	for i := range results {
+		assert.Equal(t, StoreResult{Status: Stored}, results[i])
+	}
+
+	retrieved, err := buffcomp.RetrieveFromQueue(2000)
+	assert.Nil(t, err)
+	assert.Len(t, retrieved, 1000)
+}
@@ -30,9 +30,11 @@
 package buffercompact
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,39 +47,232 @@ var (
 	DedupeKeyPrefix  = "unique_value:%s"
 )
 
+// RetrieveError is returned by RetrieveFromQueue, together with the items that
+// were released, when the records of some keys could not be read. Failed keys
+// are queued again for a later retrieval, unless their record is invalid, in
+// which case it is quarantined, see WithOnQuarantine.
+type RetrieveError struct {
+	Keys []string // keys that failed, in release order
+	Errs []error  // Errs[i] is why Keys[i] failed
+
+	nodes []*sortedset.SortedSetNode
+}
+
+func (e *RetrieveError) Error() string {
+	msgs := make([]string, len(e.Keys))
+	for i := range e.Keys {
+		msgs[i] = fmt.Sprintf("%s: %v", e.Keys[i], e.Errs[i])
+	}
+	return fmt.Sprintf("failed to retrieve %d keys: %s", len(e.Keys), strings.Join(msgs, ", "))
+}
+
+// Unwrap returns the first failure so errors.Is can match it.
+func (e *RetrieveError) Unwrap() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e.Errs[0]
+}
+
+func (e *RetrieveError) add(node *sortedset.SortedSetNode, err error) {
+	e.Keys = append(e.Keys, node.Key())
+	e.Errs = append(e.Errs, err)
+	//a record that cannot be decoded would only fail again
+	if !errors.Is(err, ErrInvalidRecord) {
+		e.nodes = append(e.nodes, node)
+	}
+}
+
 type BufferCompactor struct {
-	db             *badger.DB
+	store          Store
 	sortedSet      *sortedset.SortedSet
 	bufferDuration time.Duration
+	bufferMode     BufferMode
+	maxDelay       time.Duration
 	mu             sync.Mutex
 
 	maxValuesCount int
+	maxBytes       int64
+	bufferedBytes  int64
+	overflow       OverflowPolicy
 	ttlDuration    *time.Duration
 	dedupeDuration *time.Duration
+	dedupeScope    DedupeScope
+	dedupeWindow   int
+	mergeFunc      MergeFunc
+	headerMerge    HeaderMergeFunc
+
+	autoDedupe        DedupeHashFunc
+	autoDedupeHeaders []string
+	filter            *dedupeFilter
+
+	leaseDuration time.Duration
+	leases        *sortedset.SortedSet
+
+	maxAttempts int
+	backoff     Backoff
+
+	onExpire     func(key string)
+	expiredCount int
+	onQuarantine func(key string, err error)
+
+	namespace string
+
+	//closed and replaced to wake subscribers, see wakeSubscribers
+	changed chan struct{}
+	//writers waiting for space in the order they arrived, see admit
+	waiters []chan struct{}
+	//room held for admitted writes that are not buffered yet, see reserve
+	reserved      map[string]int
+	reservedBytes int64
 }
 
 type BufferCompactorOption func(*BufferCompactor)
 
+// BufferMode decides how further writes to a buffered key move its release
+// time.
+type BufferMode int
+
+const (
+	// FixedWindow releases a key bufferDuration after its first write, or
+	// sooner if a later write is scheduled earlier.
+	FixedWindow BufferMode = iota
+	// SlidingWindow releases a key bufferDuration after its latest write,
+	// debouncing keys that keep being written.
+	SlidingWindow
+)
+
+// MergeFunc combines the value already buffered under key with a newly stored
+// value. The result replaces the buffered value.
+type MergeFunc func(key string, old, new []byte) ([]byte, error)
+
+// HeaderMergeFunc combines the headers already buffered under key with the
+// headers of a newly stored item. The result replaces the buffered headers.
+type HeaderMergeFunc func(key string, old, new map[string][]byte) map[string][]byte
+
+// ReplaceHeaders keeps only the headers of the latest write. It is the
+// default HeaderMergeFunc.
+func ReplaceHeaders(key string, old, new map[string][]byte) map[string][]byte {
+	return new
+}
+
+// MergeHeaders keeps the headers of every write, with later writes
+// overwriting headers of the same name.
+func MergeHeaders(key string, old, new map[string][]byte) map[string][]byte {
+	if len(old) == 0 {
+		return new
+	}
+	merged := make(map[string][]byte, len(old)+len(new))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range new {
+		merged[k] = v
+	}
+	return merged
+}
+
 type StorageItem struct {
 	Key      string
 	Value    []byte
 	UniqueID string
 
-	score int64
+	// Headers are stored with the value. How the headers of compacted writes
+	// combine is set with WithHeaderMergeFunc.
+	Headers map[string][]byte
+
+	// Delay overrides the compactor's buffer duration for this write.
+	Delay time.Duration
+	// ReleaseAt schedules this write for an absolute time and takes
+	// precedence over Delay.
+	ReleaseAt time.Time
+
+	// Attempts is the number of times the item has been nacked. It is set on
+	// retrieved items and ignored when storing.
+	Attempts int
+	// LeaseToken identifies the lease on an item retrieved with WithLease and
+	// has to be passed to Ack and Nack. It is ignored when storing.
+	LeaseToken int64
+
+	score         int64
+	firstSeen     int64
+	lastUpdate    int64
+	writes        int
+	leaseDeadline int64
+}
+
+// Writes returns how many writes were compacted into a retrieved item.
+func (s *StorageItem) Writes() int {
+	return s.writes
 }
 
+// FirstSeen returns when the first write compacted into a retrieved item was
+// stored. It is zero for items stored by versions that did not record it.
+func (s *StorageItem) FirstSeen() time.Time {
+	return scoreTime(s.firstSeen)
+}
+
+// LastWrite returns when the latest write compacted into a retrieved item
+// was stored. It is zero for items stored by versions that did not record it.
+func (s *StorageItem) LastWrite() time.Time {
+	return scoreTime(s.lastUpdate)
+}
+
+// ScheduledRelease returns when a retrieved item was due to be released.
+func (s *StorageItem) ScheduledRelease() time.Time {
+	return scoreTime(s.score)
+}
+
+// New creates a BufferCompactor persisted to the given badger.DB
 func New(db *badger.DB, bufferDuration time.Duration, opts ...BufferCompactorOption) (*BufferCompactor, error) {
+	return NewCtx(context.Background(), db, bufferDuration, opts...)
+}
+
+// NewCtx is New with a context that can cancel loading the existing keys
+func NewCtx(ctx context.Context, db *badger.DB, bufferDuration time.Duration, opts ...BufferCompactorOption) (*BufferCompactor, error) {
+	return NewWithStoreCtx(ctx, NewBadgerStore(db), bufferDuration, opts...)
+}
+
+// NewWithStore creates a BufferCompactor persisted to any Store implementation
+func NewWithStore(store Store, bufferDuration time.Duration, opts ...BufferCompactorOption) (*BufferCompactor, error) {
+	return NewWithStoreCtx(context.Background(), store, bufferDuration, opts...)
+}
+
+// NewWithStoreCtx is NewWithStore with a context that can cancel loading the existing keys
+func NewWithStoreCtx(ctx context.Context, store Store, bufferDuration time.Duration, opts ...BufferCompactorOption) (*BufferCompactor, error) {
 	buffComp := BufferCompactor{
-		db:             db,
+		store:          store,
 		sortedSet:      sortedset.New(),
 		bufferDuration: bufferDuration,
+		headerMerge:    ReplaceHeaders,
+		leases:         sortedset.New(),
+		changed:        make(chan struct{}),
+		reserved:       make(map[string]int),
 	}
 
 	for _, opt := range opts {
 		opt(&buffComp)
 	}
+	if buffComp.filter != nil && buffComp.dedupeScope != DedupeGlobal {
+		return nil, ErrDedupeFilterScope
+	}
 
-	if err := buffComp.PopulateSetFromDB(); err != nil {
+	if buffComp.namespace != "" {
+		var err error
+		if store, err = useNamespace(store, buffComp.namespace); err != nil {
+			return nil, err
+		}
+		buffComp.store = store
+	}
+	if err := migrateStore(store); err != nil {
+		return nil, err
+	}
+	if buffComp.filter != nil {
+		if err := buffComp.loadDedupeFilter(); err != nil {
+			return nil, err
+		}
+	}
+	if err := buffComp.PopulateSetFromDBCtx(ctx); err != nil {
 		return nil, err
 	}
 
@@ -102,163 +297,471 @@ func WithTTL(ttlDuration time.Duration) BufferCompactorOption {
 	}
 }
 
+// WithDedupeDuration expires dedupe markers after ttlDuration, independently
+// of the items they were written with.
 func WithDedupeDuration(ttlDuration time.Duration) BufferCompactorOption {
 	return func(b *BufferCompactor) {
-		b.ttlDuration = &ttlDuration
+		b.dedupeDuration = &ttlDuration
 	}
 }
 
-func (b *BufferCompactor) StoreToQueue(item StorageItem) error {
-	if b.maxValuesCount != 0 && b.sortedSet.GetCount() >= b.maxValuesCount {
-		return ErrMaxValueCount
+// WithBufferMode selects how writes to an already buffered key affect its
+// release time. The default is FixedWindow.
+func WithBufferMode(mode BufferMode) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.bufferMode = mode
 	}
+}
 
-	score := time.Now().Add(b.bufferDuration).Unix()
-	item.score = score
+// WithMaxDelay caps how long a key can stay buffered after its first write,
+// so that a SlidingWindow key that is written constantly is still released.
+func WithMaxDelay(maxDelay time.Duration) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.maxDelay = maxDelay
+	}
+}
 
-	err := b.db.Update(func(txn *badger.Txn) error {
-		//Dedupe Block
-		if item.UniqueID != "" {
-			dedupeKey := []byte(fmt.Sprintf(DedupeKeyPrefix, item.Key))
-			if existingItem, _ := txn.Get(dedupeKey); existingItem != nil {
-				var existingUniqueIDbytes []byte
-				existingUniqueIDbytes, _ = existingItem.ValueCopy(existingUniqueIDbytes)
-				if string(existingUniqueIDbytes) == item.UniqueID {
-					//value match skipping store for dedupe
-					return nil
-				}
+// WithMergeFunc compacts writes to a buffered key with fn instead of keeping
+// only the last value. fn runs inside the store's write transaction.
+func WithMergeFunc(fn MergeFunc) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.mergeFunc = fn
+	}
+}
+
+// WithHeaderMergeFunc decides how the headers of writes to a buffered key
+// combine. The default is ReplaceHeaders.
+func WithHeaderMergeFunc(fn HeaderMergeFunc) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.headerMerge = fn
+	}
+}
+
+// StoreToQueue buffers item and reports whether it was stored under a new
+// key, compacted into a buffered one or dropped for dedupe. Items that are
+// not written are Rejected along with the reason.
+func (b *BufferCompactor) StoreToQueue(item StorageItem) (StoreStatus, error) {
+	return b.StoreToQueueCtx(context.Background(), item)
+}
+
+// StoreToQueueCtx is StoreToQueue that gives up if ctx is done before the item is written
+func (b *BufferCompactor) StoreToQueueCtx(ctx context.Context, item StorageItem) (StoreStatus, error) {
+	return b.storeItem(ctx, item, b.overflow == OverflowBlock)
+}
+
+// StoreToQueueWait is StoreToQueueCtx that waits for space when the queue is
+// full, whatever the overflow policy. Writers are let in in the order they
+// started waiting. Writes to a key that is already buffered add no key, so
+// only the bytes they add can make them wait.
+func (b *BufferCompactor) StoreToQueueWait(ctx context.Context, item StorageItem) (StoreStatus, error) {
+	return b.storeItem(ctx, item, true)
+}
+
+// storeItem stores item, waiting for space when wait is set.
+func (b *BufferCompactor) storeItem(ctx context.Context, item StorageItem, wait bool) (StoreStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return Rejected, err
+	}
+
+	res, err := b.admit(ctx, item.Key, int64(len(item.Value)), wait)
+	if err != nil {
+		return Rejected, err
+	}
+	status, rec, err := b.writeItem(item)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.release(res)
+	if err != nil || status == Deduplicated {
+		return status, err
+	}
+	b.buffer(item.Key, rec)
+	return status, nil
+}
+
+// writeItem writes item to the store without buffering it, returning the
+// written record.
+func (b *BufferCompactor) writeItem(item StorageItem) (StoreStatus, record, error) {
+	now := time.Now()
+	item.UniqueID = b.uniqueID(item)
+	claimed := b.filter != nil && item.UniqueID != ""
+	if claimed {
+		if b.claimUniqueID(item.UniqueID, now) {
+			return Deduplicated, record{}, nil
+		}
+	}
+
+	var rec record
+	entry := b.storeEntry(item, &rec, now)
+	stored, err := b.store.Put(entry)
+	if claimed {
+		b.finishUniqueIDs(err == nil && stored, item.UniqueID)
+	}
+	if err != nil {
+		return Rejected, record{}, err
+	}
+	if !stored {
+		//value match skipping store for dedupe
+		return Deduplicated, record{}, nil
+	}
+	return rec.status(), rec, nil
+}
+
+// storeEntry builds the StoreEntry that writes item, whose UniqueID has been
+// resolved with uniqueID. rec is set to the record the entry ends up writing.
+func (b *BufferCompactor) storeEntry(item StorageItem, rec *record, now time.Time) StoreEntry {
+	*rec, _ = b.compactRecord(item, nil, now)
+
+	entry := StoreEntry{
+		Key:   itemKey(item.Key),
+		Value: encodeRecord(*rec),
+		Merge: func(existing []byte) ([]byte, error) {
+			old, err := decodeRecord(existing)
+			if err != nil {
+				return nil, err
+			}
+			if *rec, err = b.compactRecord(item, &old, now); err != nil {
+				return nil, err
+			}
+			return encodeRecord(*rec), nil
+		},
+	}
+	if b.ttlDuration != nil {
+		entry.TTL = *b.ttlDuration
+	}
+	b.setDedupe(&entry, item)
+	return entry
+}
+
+// buffer queues key for release once rec is stored. The caller must hold
+// b.mu.
+func (b *BufferCompactor) buffer(key string, rec record) {
+	//a write to a leased key cancels the lease and buffers the key again
+	b.leases.Remove(key)
+	b.enqueue(key, sortedset.SCORE(rec.score), int64(len(rec.value)))
+	b.wakeSubscribers(b.sortedSet, key)
+}
+
+// compactRecord builds the record to store for item given the record
+// already buffered under its key, if there is one.
+func (b *BufferCompactor) compactRecord(item StorageItem, old *record, now time.Time) (record, error) {
+	rec := record{
+		value:      item.Value,
+		score:      toScore(b.releaseTime(item, now)),
+		firstSeen:  toScore(now),
+		lastUpdate: toScore(now),
+		writes:     1,
+		uniqueID:   item.UniqueID,
+		headers:    item.Headers,
+	}
+
+	if old != nil {
+		//lease tokens keep growing, so a lease before this write never matches a later one
+		rec.lease = old.lease
+		rec.headers = b.headerMerge(item.Key, old.headers, item.Headers)
+		if b.mergeFunc != nil {
+			merged, err := b.mergeFunc(item.Key, old.value, item.Value)
+			if err != nil {
+				return record{}, err
 			}
+			rec.value = merged
+			rec.attempts = old.attempts
+		}
 
-			dupeEntry := badger.NewEntry(dedupeKey, []byte(item.UniqueID))
-			if b.dedupeDuration != nil {
-				dupeEntry.WithTTL(*b.dedupeDuration)
+		//a leased record has already been released, so a new window starts
+		if !old.leased {
+			if old.firstSeen != 0 {
+				rec.firstSeen = old.firstSeen
 			}
-			if err := txn.SetEntry(dupeEntry); err != nil {
-				return err
+			rec.writes = old.writes + 1
+			//fixed windows only ever move the release earlier, which keeps
+			//the first write's time unless an item asks for sooner
+			if b.bufferMode == FixedWindow && old.score < rec.score {
+				rec.score = old.score
 			}
 		}
+	}
 
-		value := appendScoreBytes(item.Value, item.score)
-		entry := badger.NewEntry([]byte(item.Key), value)
-		if b.ttlDuration != nil {
-			entry.WithTTL(*b.ttlDuration)
+	if b.maxDelay > 0 {
+		if latest := rec.firstSeen + b.maxDelay.Milliseconds(); rec.score > latest {
+			rec.score = latest
 		}
-		err := txn.SetEntry(entry)
-		return err
-	})
-	if err != nil {
-		return err
 	}
+	return rec, nil
+}
 
-	if node := b.sortedSet.GetByKey(item.Key); node == nil {
-		b.sortedSet.AddOrUpdate(item.Key, sortedset.SCORE(score), struct{}{})
+// releaseTime is when item should be released if nothing else were buffered
+// under its key.
+func (b *BufferCompactor) releaseTime(item StorageItem, now time.Time) time.Time {
+	switch {
+	case !item.ReleaseAt.IsZero():
+		return item.ReleaseAt
+	case item.Delay > 0:
+		return now.Add(item.Delay)
+	default:
+		return now.Add(b.bufferDuration)
 	}
-	return nil
 }
 
 func (b *BufferCompactor) RetrieveFromQueue(limit int) ([]*StorageItem, error) {
+	return b.RetrieveFromQueueCtx(context.Background(), limit)
+}
+
+// RetrieveFromQueueCtx is RetrieveFromQueue that stops once ctx is done. The items
+// released so far are returned along with the context's error and the rest stay queued.
+func (b *BufferCompactor) RetrieveFromQueueCtx(ctx context.Context, limit int) ([]*StorageItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var nodes []*sortedset.SortedSetNode
 
 	//lock here to allow for multiple caller threads
 	b.mu.Lock()
+	if b.leaseDuration > 0 {
+		b.requeueExpiredLeases(time.Now())
+	}
 	//if max set length is hit, aggressively remove items disregarding
 	//buffer duration
-	if b.maxValuesCount != 0 && b.sortedSet.GetCount() >= b.maxValuesCount {
+	if b.full() {
 		nodes = b.sortedSet.GetByRankRange(1, limit, true)
 	} else {
-		end := sortedset.SCORE(time.Now().Unix())
+		end := sortedset.SCORE(toScore(time.Now()))
 		nodes = b.sortedSet.GetByScoreRange(-1, end, &sortedset.GetByScoreRangeOptions{
 			Limit:  limit,
 			Remove: true})
 	}
+	b.dequeued(nodes)
 	b.mu.Unlock()
 
-	response := make([]*StorageItem, 0, len(nodes))
+	if b.leaseDuration > 0 {
+		return b.leaseNodes(ctx, nodes)
+	}
+	return b.removeNodes(ctx, nodes)
+}
 
-	//TODO there is obvious performace improvement opportunity in a bulk transaction.
-	//but need to weigh the risk of the transaction errors by growing too large.
-	//https://dgraph.io/docs/badger/get-started/#read-write-transactions (check example here)
+// removeNodes reads and deletes the records of nodes taken from the sortedset
+// in bulk. Nodes whose records could not be removed are put back and nodes
+// whose records expired are dropped.
+func (b *BufferCompactor) removeNodes(ctx context.Context, nodes []*sortedset.SortedSetNode) ([]*StorageItem, error) {
+	if err := ctx.Err(); err != nil {
+		b.restoreNodes(nodes)
+		return nil, err
+	}
+
+	keys := make([]string, len(nodes))
+	storeKeys := make([]string, len(nodes))
 	for i := range nodes {
-		item, err := b.RemoveFromDB(nodes[i].Key())
+		keys[i] = nodes[i].Key()
+		storeKeys[i] = itemKey(keys[i])
+	}
+	values, errs := b.store.GetAndDeleteBatch(storeKeys)
 
-		if err != nil {
-			return nil, err
+	response := make([]*StorageItem, 0, len(nodes))
+	var retrieveErr RetrieveError
+	var expired []string
+	for i := range nodes {
+		switch {
+		case errs[i] == ErrNotFound:
+			expired = append(expired, keys[i])
+		case errs[i] != nil:
+			retrieveErr.add(nodes[i], errs[i])
+		default:
+			rec, err := decodeRecord(values[i])
+			if err != nil {
+				//a record that cannot be moved aside is reported instead
+				if qErr := b.quarantine(keys[i], true, values[i], err); qErr != nil {
+					err = qErr
+				}
+				retrieveErr.add(nodes[i], err)
+				continue
+			}
+			response = append(response, newStorageItem(keys[i], rec))
 		}
-		response = append(response, item)
 	}
+	b.expire(expired)
 
-	return response, nil
+	return response, b.settleFailures(&retrieveErr)
 }
 
-//RemoveFromDB reads and deletes by key from badger in a read-write transaction
-func (b *BufferCompactor) RemoveFromDB(key string) (*StorageItem, error) {
-	txn := b.db.NewTransaction(true)
-	defer txn.Discard()
+// WaitAndRetrieve blocks until at least one item is released, or ctx is done,
+// and returns up to limit items.
+func (b *BufferCompactor) WaitAndRetrieve(ctx context.Context, limit int) ([]*StorageItem, error) {
+	return b.nextBatch(ctx, SubscribeOptions{BatchSize: limit})
+}
 
-	item, err := txn.Get([]byte(key))
-	if err != nil {
-		return nil, err
+// settleFailures queues the failed keys of retrieveErr again and returns
+// retrieveErr, or nil if nothing failed.
+func (b *BufferCompactor) settleFailures(retrieveErr *RetrieveError) error {
+	if len(retrieveErr.Keys) == 0 {
+		return nil
 	}
-	if err := txn.Delete([]byte(key)); err != nil {
-		return nil, err
+
+	b.restoreNodes(retrieveErr.nodes)
+	return retrieveErr
+}
+
+// restoreNodes puts nodes taken from the sortedset back unless their key was
+// stored again in the meantime.
+func (b *BufferCompactor) restoreNodes(nodes []*sortedset.SortedSetNode) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, node := range nodes {
+		if b.sortedSet.GetByKey(node.Key()) == nil {
+			b.enqueue(node.Key(), node.Score(), nodeSize(node))
+			b.wakeSubscribers(b.sortedSet, node.Key())
+		}
 	}
+}
 
-	if err := txn.Commit(); err != nil {
+// restoreItems writes items that were removed from the store but never handed
+// out back to it and queues them again at their old release time. A write
+// stored to the key since is merged on top of the item when WithMergeFunc is
+// used, and otherwise replaces it as it would have if the item had still been
+// buffered.
+func (b *BufferCompactor) restoreItems(items []*StorageItem) error {
+	for _, item := range items {
+		rec := record{
+			value:      item.Value,
+			score:      item.score,
+			firstSeen:  item.firstSeen,
+			lastUpdate: item.lastUpdate,
+			writes:     item.writes,
+			attempts:   item.Attempts,
+			uniqueID:   item.UniqueID,
+			headers:    item.Headers,
+		}
+		restored := rec
+		entry := StoreEntry{
+			Key:   itemKey(item.Key),
+			Value: encodeRecord(rec),
+			Merge: func(existing []byte) ([]byte, error) {
+				newer, err := decodeRecord(existing)
+				if err != nil {
+					return nil, err
+				}
+				restored = newer
+				if b.mergeFunc != nil {
+					if restored.value, err = b.mergeFunc(item.Key, rec.value, newer.value); err != nil {
+						return nil, err
+					}
+					restored.headers = b.headerMerge(item.Key, rec.headers, newer.headers)
+					restored.firstSeen = rec.firstSeen
+					restored.writes += rec.writes
+				}
+				if rec.score < restored.score {
+					restored.score = rec.score
+				}
+				return encodeRecord(restored), nil
+			},
+		}
+		if b.ttlDuration != nil {
+			entry.TTL = *b.ttlDuration
+		}
+		if _, err := b.store.Put(entry); err != nil {
+			return fmt.Errorf("%s: %w", item.Key, err)
+		}
+
+		b.mu.Lock()
+		b.buffer(item.Key, restored)
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// RemoveFromDB reads and deletes by key from the store in a single atomic operation
+func (b *BufferCompactor) RemoveFromDB(key string) (*StorageItem, error) {
+	return b.RemoveFromDBCtx(context.Background(), key)
+}
+
+// RemoveFromDBCtx is RemoveFromDB that gives up if ctx is done before the key is removed
+func (b *BufferCompactor) RemoveFromDBCtx(ctx context.Context, key string) (*StorageItem, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	var value []byte
-	value, err = item.ValueCopy(value)
+	value, err := b.store.GetAndDelete(itemKey(key))
+	if err != nil {
+		return nil, err
+	}
+	rec, err := decodeRecord(value)
 	if err != nil {
 		return nil, err
 	}
 
-	score, strippedValue := removeScoreBytes(value)
+	return newStorageItem(key, rec), nil
+}
 
+func newStorageItem(key string, rec record) *StorageItem {
 	return &StorageItem{
-		Key:   key,
-		Value: strippedValue,
-		score: score,
-	}, nil
+		Key:      key,
+		Value:    rec.value,
+		UniqueID: rec.uniqueID,
+		Headers:  rec.headers,
+		Attempts: rec.attempts,
+
+		score:      rec.score,
+		firstSeen:  rec.firstSeen,
+		lastUpdate: rec.lastUpdate,
+		writes:     rec.writes,
+	}
 }
 
-//PopulateSetFromDB allows for badgerDB persistance by loading all keys and score from db on startup
-//    into the sortedset.
+// PopulateSetFromDB allows for store persistance by loading all item keys and score from the store on startup
+// into the sortedset. Leased records are restored as leases that expire at their stored score.
 func (b *BufferCompactor) PopulateSetFromDB() error {
-	err := b.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			err := item.Value(func(v []byte) error {
-				score, _ := removeScoreBytes(v)
-				if node := b.sortedSet.GetByKey(string(k)); node == nil {
-					b.sortedSet.AddOrUpdate(string(k), sortedset.SCORE(score), struct{}{})
-				}
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+	return b.PopulateSetFromDBCtx(context.Background())
+}
+
+// PopulateSetFromDBCtx is PopulateSetFromDB that stops scanning once ctx is done
+func (b *BufferCompactor) PopulateSetFromDBCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var invalidKeys []string
+	var invalidErrs []error
+	b.mu.Lock()
+	prefix := itemKey("")
+	err := b.store.ScanPrefix(prefix, func(key string, value []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key = strings.TrimPrefix(key, prefix)
+		rec, err := decodeRecord(value)
+		if err != nil {
+			invalidKeys = append(invalidKeys, key)
+			invalidErrs = append(invalidErrs, err)
+			return nil
+		}
+		if rec.leased && b.leaseDuration > 0 {
+			b.leases.AddOrUpdate(key, sortedset.SCORE(rec.score), leaseValue{size: int64(len(rec.value)), token: rec.lease})
+			return nil
+		}
+		if node := b.sortedSet.GetByKey(key); node == nil {
+			b.enqueue(key, sortedset.SCORE(rec.score), int64(len(rec.value)))
 		}
 		return nil
 	})
-
+	b.mu.Unlock()
 	if err != nil {
 		return err
 	}
 
+	//invalid records are moved aside so they do not fail every start
+	for i, key := range invalidKeys {
+		if err := b.quarantine(key, false, nil, invalidErrs[i]); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
 	return nil
 }
 
 func appendScoreBytes(input []byte, score int64) []byte {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(score))
-
-	final := append(input, b...)
+	final := make([]byte, len(input)+8)
+	copy(final, input)
+	binary.LittleEndian.PutUint64(final[len(input):], uint64(score))
 
 	return final
 }
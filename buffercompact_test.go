@@ -1,6 +1,7 @@
 package buffercompact
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -58,7 +59,7 @@ func Test_MaxValuesCountCase(t *testing.T) {
 
 	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
 	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
-	err = buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
 	assert.EqualError(t, err, ErrMaxValueCount.Error())
 
 	//No Wait but MaxValue empties memory db values
@@ -115,22 +116,22 @@ func Test_StoreToQueue(test *testing.T) {
 			buffcomp, err := New(db, bufferDuration, WithSortedSet(sortedset))
 			assert.Nil(t, err)
 
-			err = buffcomp.StoreToQueue(c.item)
+			_, err = buffcomp.StoreToQueue(c.item)
 			if c.expectedErr == nil {
 				assert.Nil(t, err)
 				node := sortedset.GetByKey(c.item.Key)
 				assert.Equal(t, c.item.Key, node.Key())
 
 				if err := db.View(func(txn *badger.Txn) error {
-					dbItem, err := txn.Get([]byte(c.item.Key))
+					dbItem, err := txn.Get([]byte(itemKey(c.item.Key)))
 					if err != nil {
 						t.Fatal("error in bagder txn")
 					}
 
 					var dbValue []byte
 					dbValue, err = dbItem.ValueCopy(dbValue)
-					_, strippedValue := removeScoreBytes(dbValue)
-					assert.Equal(t, c.item.Value, strippedValue)
+					rec, _ := decodeRecord(dbValue)
+					assert.Equal(t, c.item.Value, rec.value)
 					return err
 				}); err != nil {
 					t.Fatal("error in bagder txn")
@@ -154,3 +155,343 @@ func Test_appendScoreBytes_removeScoreBytes(t *testing.T) {
 	assert.Equal(t, value, actualValue)
 	assert.Equal(t, score, actualScore)
 }
+
+func Test_NewWithStore(t *testing.T) {
+	store := NewMemoryStore()
+	bufferDuration := 1 * time.Second
+
+	buffcomp, err := NewWithStore(store, bufferDuration)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2")})
+
+	//Reload from the same store
+	buffcomp2, err := NewWithStore(store, bufferDuration)
+	assert.Nil(t, err)
+
+	time.Sleep(2 * time.Second)
+	items, err := buffcomp2.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue2"), items[0].Value)
+}
+
+func Test_MergeFuncCase(t *testing.T) {
+	db, _ := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	bufferDuration := 1 * time.Second
+	errMerge := errors.New("merge failed")
+
+	buffcomp, err := New(db, bufferDuration, WithMergeFunc(func(key string, old, new []byte) ([]byte, error) {
+		if string(new) == "bad" {
+			return nil, errMerge
+		}
+		return append(append(old, ','), new...), nil
+	}))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("a")})
+	assert.Nil(t, err)
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("b")})
+	assert.Nil(t, err)
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("bad")})
+	assert.Equal(t, errMerge, err)
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("c")})
+	assert.Nil(t, err)
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("d")})
+	assert.Nil(t, err)
+
+	time.Sleep(2 * time.Second)
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, []byte("a,b,c"), items[0].Value)
+	assert.Equal(t, []byte("d"), items[1].Value)
+}
+
+func Test_encodeRecord_decodeRecord(t *testing.T) {
+	now := time.Now()
+	rec := record{value: []byte("test-value"), score: toScore(now), firstSeen: toScore(now), lastUpdate: toScore(now),
+		writes: 2, uniqueID: "id1", attempts: 3, lease: 7, leased: true, headers: map[string][]byte{"a": []byte("1"), "b": []byte("2")}}
+	decoded, err := decodeRecord(encodeRecord(rec))
+	assert.Nil(t, err)
+	assert.Equal(t, rec, decoded)
+
+	decoded, err = decodeRecord(encodeRecord(record{}))
+	assert.Nil(t, err)
+	assert.Equal(t, record{value: []byte{}}, decoded)
+
+	//Unversioned values only carry the score, in seconds
+	seconds := now.Unix()
+	legacy := appendScoreBytes([]byte("test-value"), seconds)
+	assertDecodes(t, record{value: []byte("test-value"), score: seconds * 1000}, legacy)
+
+	//Malformed values are reported instead of panicking
+	encoded := encodeRecord(rec)
+	for _, value := range [][]byte{nil, {0}, {recordVersion1}, {9}, encoded[len(encoded)-10:]} {
+		_, err := decodeRecord(value)
+		assert.True(t, errors.Is(err, ErrInvalidRecord), "%v", value)
+	}
+}
+
+func assertDecodes(t *testing.T, expected record, value []byte) {
+	t.Helper()
+	rec, err := decodeRecord(value)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, rec)
+}
+
+func Test_BufferModes(test *testing.T) {
+	cases := map[string]struct {
+		opts          []BufferCompactorOption
+		expectedMoved bool
+	}{
+		"Fixed Window": {
+			expectedMoved: false,
+		},
+		"Sliding Window": {
+			opts:          []BufferCompactorOption{WithBufferMode(SlidingWindow)},
+			expectedMoved: true,
+		},
+	}
+
+	for name, c := range cases {
+		test.Run(name, func(t *testing.T) {
+			buffcomp, err := NewWithStore(NewMemoryStore(), time.Minute, c.opts...)
+			assert.Nil(t, err)
+
+			buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+			first := buffcomp.sortedSet.GetByKey("test1").Score()
+
+			time.Sleep(1100 * time.Millisecond)
+			buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2")})
+			second := buffcomp.sortedSet.GetByKey("test1").Score()
+
+			assert.Equal(t, c.expectedMoved, second > first)
+		})
+	}
+}
+
+func Test_MaxDelayCase(t *testing.T) {
+	store := NewMemoryStore()
+	opts := []BufferCompactorOption{WithBufferMode(SlidingWindow), WithMaxDelay(time.Second)}
+	buffcomp, err := NewWithStore(store, time.Minute, opts...)
+	assert.Nil(t, err)
+
+	start := toScore(time.Now())
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	first := buffcomp.sortedSet.GetByKey("test1").Score()
+	assert.InDelta(t, start+1000, int64(first), 10)
+
+	//The cap holds across restarts
+	buffcomp2, err := NewWithStore(store, time.Minute, opts...)
+	assert.Nil(t, err)
+	buffcomp2.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2")})
+	assert.Equal(t, first, buffcomp2.sortedSet.GetByKey("test1").Score())
+
+	time.Sleep(2 * time.Second)
+	items, err := buffcomp2.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue2"), items[0].Value)
+}
+
+func Test_PerItemReleaseTime(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Minute)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	buffcomp.StoreToQueue(StorageItem{Key: "priority", Value: []byte("testValue1"), ReleaseAt: now})
+	buffcomp.StoreToQueue(StorageItem{Key: "bulk", Value: []byte("testValue2"), Delay: time.Hour})
+	buffcomp.StoreToQueue(StorageItem{Key: "default", Value: []byte("testValue3")})
+
+	assert.Equal(t, sortedset.SCORE(toScore(now)), buffcomp.sortedSet.GetByKey("priority").Score())
+	assert.InDelta(t, toScore(now.Add(time.Hour)), int64(buffcomp.sortedSet.GetByKey("bulk").Score()), 10)
+	assert.InDelta(t, toScore(now.Add(time.Minute)), int64(buffcomp.sortedSet.GetByKey("default").Score()), 10)
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "priority", items[0].Key)
+
+	//An earlier write pulls a fixed window forward
+	buffcomp.StoreToQueue(StorageItem{Key: "bulk", Value: []byte("testValue4"), ReleaseAt: now})
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "bulk", items[0].Key)
+	assert.Equal(t, []byte("testValue4"), items[0].Value)
+}
+
+func Test_SubSecondBuffer(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 200*time.Millisecond)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+
+	time.Sleep(250 * time.Millisecond)
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+func Test_PopulateSetFromDB_SecondScores(t *testing.T) {
+	db, _ := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+
+	//Values written with second precision scores by earlier versions
+	past := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+	db.Update(func(txn *badger.Txn) error {
+		txn.Set([]byte("test1"), appendScoreBytes([]byte("testValue1"), past))
+		return txn.Set([]byte("test2"), appendScoreBytes([]byte("testValue2"), future))
+	})
+
+	buffcomp, err := New(db, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, sortedset.SCORE(future*1000), buffcomp.sortedSet.GetByKey("test2").Score())
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+}
+
+// failingStore fails to remove the keys in failKeys
+type failingStore struct {
+	*MemoryStore
+	failKeys map[string]bool
+}
+
+func (s *failingStore) GetAndDeleteBatch(keys []string) ([][]byte, []error) {
+	var pass []string
+	for _, key := range keys {
+		if !s.failKeys[key] {
+			pass = append(pass, key)
+		}
+	}
+	passValues, passErrs := s.MemoryStore.GetAndDeleteBatch(pass)
+
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if s.failKeys[key] {
+			errs[i] = errors.New("remove failed")
+			continue
+		}
+		values[i], errs[i] = passValues[0], passErrs[0]
+		passValues, passErrs = passValues[1:], passErrs[1:]
+	}
+	return values, errs
+}
+
+func Test_RetrieveFromQueue_RestoresFailedKeys(t *testing.T) {
+	store := &failingStore{MemoryStore: NewMemoryStore(), failKeys: map[string]bool{itemKey("test2"): true}}
+	buffcomp, err := NewWithStore(store, 0)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	var retrieveErr *RetrieveError
+	assert.True(t, errors.As(err, &retrieveErr))
+	assert.Equal(t, []string{"test2"}, retrieveErr.Keys)
+	assert.EqualError(t, retrieveErr.Errs[0], "remove failed")
+	assert.Len(t, items, 2)
+
+	//The failed key is still queued
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test2"))
+	store.failKeys = nil
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "test2", items[0].Key)
+}
+
+func Test_Headers(test *testing.T) {
+	cases := map[string]struct {
+		opts            []BufferCompactorOption
+		expectedHeaders map[string][]byte
+	}{
+		"Replace": {
+			expectedHeaders: map[string][]byte{"trace-id": []byte("2")},
+		},
+		"Merge": {
+			opts:            []BufferCompactorOption{WithHeaderMergeFunc(MergeHeaders)},
+			expectedHeaders: map[string][]byte{"trace-id": []byte("2"), "content-type": []byte("json")},
+		},
+	}
+
+	for name, c := range cases {
+		test.Run(name, func(t *testing.T) {
+			buffcomp, err := NewWithStore(NewMemoryStore(), 0, c.opts...)
+			assert.Nil(t, err)
+
+			buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"),
+				Headers: map[string][]byte{"trace-id": []byte("1"), "content-type": []byte("json")}})
+			buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2"),
+				Headers: map[string][]byte{"trace-id": []byte("2")}})
+
+			items, err := buffcomp.RetrieveFromQueue(10)
+			assert.Nil(t, err)
+			assert.Len(t, items, 1)
+			assert.Equal(t, c.expectedHeaders, items[0].Headers)
+		})
+	}
+}
+
+func Test_CompactionStats(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 100*time.Millisecond)
+	assert.Nil(t, err)
+
+	start := time.Now().Truncate(time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	time.Sleep(20 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue3")})
+
+	time.Sleep(150 * time.Millisecond)
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	item := items[0]
+	assert.Equal(t, 3, item.Writes())
+	assert.False(t, item.FirstSeen().Before(start))
+	assert.GreaterOrEqual(t, int64(item.LastWrite().Sub(item.FirstSeen())), int64(20*time.Millisecond))
+	assert.Equal(t, item.FirstSeen().Add(100*time.Millisecond), item.ScheduledRelease())
+}
+
+func Test_StoreToQueue_Status(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxValueCount(2))
+	assert.Nil(t, err)
+
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Deduplicated, status)
+
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+	assert.Equal(t, ErrMaxValueCount, err)
+	assert.Equal(t, Rejected, status)
+
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2"), UniqueID: "id2"})
+	assert.Nil(t, err)
+	assert.Equal(t, Compacted, status)
+
+	item, err := buffcomp.RemoveFromDB("test1")
+	assert.Nil(t, err)
+	assert.Equal(t, "id2", item.UniqueID)
+}
@@ -0,0 +1,348 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"context"
+	"errors"
+
+	"github.com/parkerroan/buffercompact/sortedset"
+)
+
+var (
+	ErrMaxBytes = errors.New("max bytes reached")
+)
+
+// OverflowPolicy decides what happens to a write that does not fit within
+// the limits set with WithMaxValueCount and WithMaxBytes.
+type OverflowPolicy int
+
+const (
+	// OverflowReject fails the write with ErrMaxValueCount or ErrMaxBytes.
+	OverflowReject OverflowPolicy = iota
+	// OverflowBlock makes StoreToQueue wait, as StoreToQueueWait does, until
+	// retrievals free up enough space or its context is done. StoreBatch
+	// rejects what does not fit.
+	OverflowBlock
+	// OverflowEvictOldest deletes the keys due soonest, without releasing
+	// them, until the write fits. Keys that are being written are skipped.
+	OverflowEvictOldest
+	// OverflowFlush accepts the write. Until the queue is back within its
+	// limits, retrievals release keys without waiting for their buffer time.
+	OverflowFlush
+)
+
+// WithMaxBytes limits the total size of the values buffered in the queue.
+// A value larger than maxBytes is only accepted into an empty queue.
+func WithMaxBytes(maxBytes int64) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.maxBytes = maxBytes
+	}
+}
+
+// WithOverflowPolicy selects what happens to writes when the queue is full.
+// The default is OverflowReject.
+func WithOverflowPolicy(policy OverflowPolicy) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.overflow = policy
+	}
+}
+
+// BufferedBytes returns the total size of the values buffered in the queue.
+func (b *BufferCompactor) BufferedBytes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.bufferedBytes
+}
+
+// reservation is the room held for an admitted write until it is released.
+type reservation struct {
+	key   string
+	bytes int64
+}
+
+// admit waits for, or makes, room for a write of size bytes to key according
+// to the overflow policy, and reserves it. When wait is set, a write that does
+// not fit joins the queue of waiters instead of failing. The caller must
+// release the reservation once the write is buffered or has failed.
+func (b *BufferCompactor) admit(ctx context.Context, key string, size int64, wait bool) (reservation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res, err := b.tryAdmit(key, size)
+	if err == nil || !wait || !isCapacityErr(err) {
+		return res, err
+	}
+
+	ready := make(chan struct{}, 1)
+	b.waiters = append(b.waiters, ready)
+	for {
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.removeWaiter(ready)
+			return reservation{}, ctx.Err()
+		case <-ready:
+		}
+		b.mu.Lock()
+
+		//only the first waiter is ever woken
+		err := b.makeRoom(key, size)
+		if isCapacityErr(err) {
+			continue
+		}
+		b.waiters = b.waiters[1:]
+		//the next waiter may fit in what is left
+		b.wakeWaiter()
+		if err != nil {
+			return reservation{}, err
+		}
+		return b.reserve(key, size), nil
+	}
+}
+
+// tryAdmit makes room for a write of size bytes to key and reserves it,
+// without waiting. A write that adds a key or grows the buffered bytes may
+// not cut in front of the writers already waiting for space. Writes to
+// buffered keys add no key, so only their size can hold them up. The caller
+// must hold b.mu.
+func (b *BufferCompactor) tryAdmit(key string, size int64) (reservation, error) {
+	if len(b.waiters) > 0 {
+		if b.addedKeys(key) > 0 {
+			return reservation{}, b.fullErr()
+		}
+		if b.maxBytes != 0 && b.growth(key, size) > 0 {
+			return reservation{}, ErrMaxBytes
+		}
+	}
+	if err := b.makeRoom(key, size); err != nil {
+		return reservation{}, err
+	}
+	return b.reserve(key, size), nil
+}
+
+// reserve holds room for a write of size bytes to key, so that concurrent
+// writes cannot take it while this one is being written to the store. The
+// caller must hold b.mu.
+func (b *BufferCompactor) reserve(key string, size int64) reservation {
+	growth := b.growth(key, size)
+	if growth < 0 {
+		//a shrinking write frees nothing until it is buffered
+		growth = 0
+	}
+	b.reserved[key]++
+	b.reservedBytes += growth
+	return reservation{key: key, bytes: growth}
+}
+
+// release gives up the room held by res and lets the first waiter check for
+// space. The caller must hold b.mu.
+func (b *BufferCompactor) release(res reservation) {
+	if b.reserved[res.key]--; b.reserved[res.key] <= 0 {
+		delete(b.reserved, res.key)
+	}
+	b.reservedBytes -= res.bytes
+	b.wakeWaiter()
+}
+
+// reservedKeys is how many keys admitted writes are about to add to the
+// queue. The caller must hold b.mu.
+func (b *BufferCompactor) reservedKeys() int {
+	var keys int
+	for key := range b.reserved {
+		if b.sortedSet.GetByKey(key) == nil {
+			keys++
+		}
+	}
+	return keys
+}
+
+// fullErr is the capacity error for a write turned away because other writers
+// are already waiting for space. The caller must hold b.mu.
+func (b *BufferCompactor) fullErr() error {
+	if b.maxBytes == 0 || (b.maxValuesCount != 0 && b.sortedSet.GetCount()+b.reservedKeys() >= b.maxValuesCount) {
+		return ErrMaxValueCount
+	}
+	return ErrMaxBytes
+}
+
+// wakeWaiter lets the first writer waiting for space check again. The caller
+// must hold b.mu.
+func (b *BufferCompactor) wakeWaiter() {
+	if len(b.waiters) == 0 {
+		return
+	}
+	select {
+	case b.waiters[0] <- struct{}{}:
+	default:
+	}
+}
+
+// removeWaiter drops a writer that stopped waiting. The caller must hold b.mu.
+func (b *BufferCompactor) removeWaiter(ready chan struct{}) {
+	for i, waiter := range b.waiters {
+		if waiter == ready {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			if i == 0 {
+				//the wake up may have been meant for ready
+				b.wakeWaiter()
+			}
+			return
+		}
+	}
+}
+
+// makeRoom checks that a write of size bytes to key fits next to the
+// reserved writes, evicting keys or letting it through when the overflow
+// policy says so. The caller must hold b.mu.
+func (b *BufferCompactor) makeRoom(key string, size int64) error {
+	for {
+		err := b.capacityErr(b.addedKeys(key), b.growth(key, size))
+		if err == nil || b.overflow == OverflowFlush {
+			return nil
+		}
+		if b.overflow != OverflowEvictOldest {
+			return err
+		}
+
+		evicted, evictErr := b.evictOldest(key)
+		if evictErr != nil {
+			return evictErr
+		}
+		if !evicted {
+			return err
+		}
+	}
+}
+
+// capacityErr reports whether extraKeys new keys, on top of the reserved
+// writes, leave room for size more bytes. Adding no keys and no bytes always
+// fits. The caller must hold b.mu.
+func (b *BufferCompactor) capacityErr(extraKeys int, size int64) error {
+	if b.maxValuesCount != 0 && extraKeys > 0 && b.sortedSet.GetCount()+b.reservedKeys()+extraKeys > b.maxValuesCount {
+		return ErrMaxValueCount
+	}
+	total := b.bufferedBytes + b.reservedBytes
+	if b.maxBytes != 0 && size > 0 && total > 0 && total+size > b.maxBytes {
+		return ErrMaxBytes
+	}
+	return nil
+}
+
+// growth is how much writing size bytes to key adds to the buffered bytes.
+// The caller must hold b.mu.
+func (b *BufferCompactor) growth(key string, size int64) int64 {
+	//merged values are only known once written, so assume they grow by size
+	if node := b.sortedSet.GetByKey(key); node != nil && b.mergeFunc == nil {
+		return size - nodeSize(node)
+	}
+	return size
+}
+
+// full reports whether the queue has reached one of its limits. The caller
+// must hold b.mu.
+func (b *BufferCompactor) full() bool {
+	return (b.maxValuesCount != 0 && b.sortedSet.GetCount() >= b.maxValuesCount) ||
+		(b.maxBytes != 0 && b.bufferedBytes >= b.maxBytes)
+}
+
+// evictOldest deletes the key due soonest and reports whether there was one.
+// Keys with a write in flight are skipped, as is key, the one being written,
+// since deleting them would drop the value the write merges into. The caller
+// must hold b.mu.
+func (b *BufferCompactor) evictOldest(key string) (bool, error) {
+	var victim string
+	b.sortedSet.IterFuncByRankRange(1, -1, func(k string, _ interface{}) bool {
+		if k == key || b.reserved[k] > 0 {
+			return true
+		}
+		victim = k
+		return false
+	})
+	if victim == "" {
+		return false, nil
+	}
+
+	node := b.sortedSet.Remove(victim)
+	if err := b.store.Delete(itemKey(victim)); err != nil {
+		//the record is still stored, so it stays queued
+		b.sortedSet.AddOrUpdate(node.Key(), node.Score(), node.Value)
+		return false, err
+	}
+	b.dequeued([]*sortedset.SortedSetNode{node})
+	return true, nil
+}
+
+// enqueue adds key to the sortedset, keeping track of its size. The caller
+// must hold b.mu.
+func (b *BufferCompactor) enqueue(key string, score sortedset.SCORE, size int64) {
+	if node := b.sortedSet.GetByKey(key); node != nil {
+		b.bufferedBytes -= nodeSize(node)
+	}
+	b.sortedSet.AddOrUpdate(key, score, size)
+	b.bufferedBytes += size
+}
+
+// dequeued accounts for nodes removed from the sortedset and wakes writers
+// waiting for space. The caller must hold b.mu.
+func (b *BufferCompactor) dequeued(nodes []*sortedset.SortedSetNode) {
+	if len(nodes) == 0 {
+		return
+	}
+	for _, node := range nodes {
+		b.bufferedBytes -= nodeSize(node)
+	}
+	b.wakeWaiter()
+}
+
+// addedKeys is how many keys a write to key adds to the queue. A key that is
+// buffered or reserved is only added once. The caller must hold b.mu.
+func (b *BufferCompactor) addedKeys(key string) int {
+	if b.sortedSet.GetByKey(key) != nil || b.reserved[key] > 0 {
+		return 0
+	}
+	return 1
+}
+
+func isCapacityErr(err error) bool {
+	return err == ErrMaxValueCount || err == ErrMaxBytes
+}
+
+func nodeSize(node *sortedset.SortedSetNode) int64 {
+	switch v := node.Value.(type) {
+	case int64:
+		return v
+	case leaseValue:
+		return v.size
+	}
+	return 0
+}
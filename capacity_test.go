@@ -0,0 +1,383 @@
+package buffercompact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BufferedBytes(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("1234")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("123456")})
+	assert.Equal(t, int64(10), buffcomp.BufferedBytes())
+
+	//a compacted write replaces the size of the old value
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("12")})
+	assert.Equal(t, int64(8), buffcomp.BufferedBytes())
+
+	_, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), buffcomp.BufferedBytes())
+}
+
+func Test_MaxBytes_Reject(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxBytes(10))
+	assert.Nil(t, err)
+
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("123456")})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("123456")})
+	assert.Equal(t, ErrMaxBytes, err)
+	assert.Equal(t, Rejected, status)
+
+	//shrinking a buffered value always fits
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("12")})
+	assert.Nil(t, err)
+	assert.Equal(t, Compacted, status)
+
+	results := buffcomp.StoreBatch([]StorageItem{
+		{Key: "test2", Value: []byte("12345")},
+		{Key: "test3", Value: []byte("12345")},
+	})
+	assert.Equal(t, []StoreResult{{Status: Stored}, {Status: Rejected, Err: ErrMaxBytes}}, results)
+	assert.Equal(t, int64(7), buffcomp.BufferedBytes())
+}
+
+func Test_MaxBytes_LargeValueIntoEmptyQueue(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxBytes(4))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("123456")})
+	assert.Nil(t, err)
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+func Test_Overflow_Block(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithMaxValueCount(1), WithOverflowPolicy(OverflowBlock))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	status, err := buffcomp.StoreToQueueCtx(ctx, StorageItem{Key: "test2", Value: []byte("testValue2")})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, Rejected, status)
+
+	done := make(chan error)
+	go func() {
+		_, err := buffcomp.StoreToQueueCtx(context.Background(), StorageItem{Key: "test2", Value: []byte("testValue2")})
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("store did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Equal(t, "test1", items[0].Key)
+	assert.Nil(t, <-done)
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test2"))
+}
+
+func Test_Overflow_EvictOldest(t *testing.T) {
+	store := NewMemoryStore()
+	buffcomp, err := NewWithStore(store, time.Hour, WithMaxBytes(10), WithOverflowPolicy(OverflowEvictOldest))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("1234")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("1234")})
+
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("1234")})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+	assert.Nil(t, buffcomp.sortedSet.GetByKey("test1"))
+	assert.Equal(t, int64(8), buffcomp.BufferedBytes())
+
+	exists, err := store.Exists([]string{itemKey("test1")})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false}, exists)
+
+	results := buffcomp.StoreBatch([]StorageItem{{Key: "test4", Value: []byte("1234")}})
+	assert.Equal(t, []StoreResult{{Status: Stored}}, results)
+	assert.Nil(t, buffcomp.sortedSet.GetByKey("test2"))
+}
+
+func Test_Overflow_Flush(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxBytes(10), WithOverflowPolicy(OverflowFlush))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("123456")})
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("123456")})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+
+	//over the limit, keys are released before their buffer time
+	items, err := buffcomp.RetrieveFromQueue(1)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "test1", items[0].Key)
+
+	items, err = buffcomp.RetrieveFromQueue(1)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+}
+
+func Test_StoreToQueueWait_FIFO(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithMaxValueCount(1))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueueWait(context.Background(), StorageItem{Key: "test0", Value: []byte("testValue0")})
+	assert.Nil(t, err)
+
+	stored := make(chan string, 3)
+	for _, key := range []string{"test1", "test2", "test3"} {
+		go func(key string) {
+			_, err := buffcomp.StoreToQueueWait(context.Background(), StorageItem{Key: key, Value: []byte("testValue")})
+			assert.Nil(t, err)
+			stored <- key
+		}(key)
+		//let each writer join the queue before the next
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	released := "test0"
+	for _, next := range []string{"test1", "test2", "test3"} {
+		items, err := buffcomp.RetrieveFromQueue(10)
+		assert.Nil(t, err)
+		assert.Len(t, items, 1)
+		assert.Equal(t, released, items[0].Key)
+		assert.Equal(t, next, <-stored)
+		released = next
+	}
+}
+
+func Test_StoreToQueueWait_BufferedKeyDoesNotBlock(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxValueCount(1))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go buffcomp.StoreToQueueWait(ctx, StorageItem{Key: "test2", Value: []byte("testValue2")})
+	time.Sleep(10 * time.Millisecond)
+
+	//the update does not have to queue up behind test2
+	status, err := buffcomp.StoreToQueueWait(ctx, StorageItem{Key: "test1", Value: []byte("testValue3")})
+	assert.Nil(t, err)
+	assert.Equal(t, Compacted, status)
+
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue4")})
+	assert.Nil(t, err)
+	assert.Equal(t, Compacted, status)
+}
+
+func Test_StoreToQueueWait_Cancel(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithMaxValueCount(1))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := buffcomp.StoreToQueueWait(ctx, StorageItem{Key: "test2", Value: []byte("testValue2")})
+		cancelled <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		_, err := buffcomp.StoreToQueueWait(context.Background(), StorageItem{Key: "test3", Value: []byte("testValue3")})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-cancelled)
+
+	//the writer behind the cancelled one takes the freed space
+	_, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test3"))
+	assert.Len(t, buffcomp.waiters, 0)
+}
+
+// slowPutStore takes a while to write, so concurrent writes overlap
+type slowPutStore struct {
+	*MemoryStore
+}
+
+func (s *slowPutStore) Put(entry StoreEntry) (bool, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.MemoryStore.Put(entry)
+}
+
+func Test_MaxValueCount_ConcurrentWriters(t *testing.T) {
+	buffcomp, err := NewWithStore(&slowPutStore{NewMemoryStore()}, time.Hour, WithMaxValueCount(5), WithMaxBytes(40))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buffcomp.StoreToQueue(StorageItem{Key: fmt.Sprintf("test%d", i), Value: []byte("testValue")})
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buffcomp.StoreBatch([]StorageItem{{Key: "batch1", Value: []byte("1")}, {Key: "batch2", Value: []byte("1")}})
+	}()
+	wg.Wait()
+
+	assert.LessOrEqual(t, buffcomp.sortedSet.GetCount(), 5)
+	assert.LessOrEqual(t, buffcomp.BufferedBytes(), int64(40))
+	assert.Len(t, buffcomp.reserved, 0)
+	assert.Equal(t, int64(0), buffcomp.reservedBytes)
+}
+
+func Test_MaxValueCount_ReleasesDeduplicatedWrites(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxValueCount(2))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Deduplicated, status)
+
+	//the deduplicated write holds no room
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+}
+
+func Test_StoreToQueue_DoesNotCutInFrontOfWaiters(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithMaxValueCount(1))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	assert.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := buffcomp.StoreToQueueWait(context.Background(), StorageItem{Key: "test2", Value: []byte("testValue2")})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+	assert.Equal(t, ErrMaxValueCount, err)
+	assert.Equal(t, Rejected, status)
+	results := buffcomp.StoreBatch([]StorageItem{{Key: "test3", Value: []byte("testValue3")}})
+	assert.Equal(t, []StoreResult{{Status: Rejected, Err: ErrMaxValueCount}}, results)
+
+	//the waiter takes the freed space
+	_, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test2"))
+}
+
+func Test_MaxBytes_BufferedKeyWaitsForBytes(t *testing.T) {
+	appendValues := func(key string, old, new []byte) ([]byte, error) {
+		return append(append([]byte(nil), old...), new...), nil
+	}
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithMaxBytes(10), WithOverflowPolicy(OverflowBlock), WithMergeFunc(appendValues))
+	assert.Nil(t, err)
+
+	_, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("12345678")})
+	assert.Nil(t, err)
+
+	//growing a buffered key waits for bytes like any other write
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		status, err := buffcomp.StoreToQueueCtx(ctx, StorageItem{Key: "test1", Value: []byte("12345678")})
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, Rejected, status)
+	}
+	assert.Equal(t, int64(8), buffcomp.BufferedBytes())
+
+	done := make(chan error)
+	go func() {
+		_, err := buffcomp.StoreToQueueWait(context.Background(), StorageItem{Key: "test1", Value: []byte("12345678")})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	results := buffcomp.StoreBatch([]StorageItem{{Key: "test2", Value: []byte("12")}})
+	assert.Equal(t, []StoreResult{{Status: Rejected, Err: ErrMaxBytes}}, results)
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Nil(t, <-done)
+	assert.Equal(t, int64(8), buffcomp.BufferedBytes())
+}
+
+func Test_Overflow_EvictOldestSkipsReservedKeys(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithMaxValueCount(2), WithOverflowPolicy(OverflowEvictOldest))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+
+	//a write to test1 is in flight, so test2 goes instead
+	buffcomp.mu.Lock()
+	res := buffcomp.reserve("test1", 10)
+	buffcomp.mu.Unlock()
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test1"))
+	assert.Nil(t, buffcomp.sortedSet.GetByKey("test2"))
+
+	buffcomp.mu.Lock()
+	buffcomp.release(res)
+	buffcomp.mu.Unlock()
+}
+
+// failingDeleteStore fails every Delete
+type failingDeleteStore struct {
+	*MemoryStore
+}
+
+func (s *failingDeleteStore) Delete(key string) error {
+	return errors.New("delete failed")
+}
+
+func Test_Overflow_EvictOldestDeleteFails(t *testing.T) {
+	buffcomp, err := NewWithStore(&failingDeleteStore{NewMemoryStore()}, time.Hour, WithMaxValueCount(1), WithOverflowPolicy(OverflowEvictOldest))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+	assert.EqualError(t, err, "delete failed")
+	assert.Equal(t, Rejected, status)
+
+	//the key whose record could not be deleted is still queued
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test1"))
+	assert.Equal(t, int64(10), buffcomp.BufferedBytes())
+}
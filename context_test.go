@@ -0,0 +1,58 @@
+package buffercompact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ContextCancelled(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0)
+	assert.Nil(t, err)
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = buffcomp.StoreToQueueCtx(ctx, StorageItem{Key: "test2", Value: []byte("testValue2")})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, buffcomp.PopulateSetFromDBCtx(ctx))
+
+	_, err = buffcomp.RemoveFromDBCtx(ctx, "test1")
+	assert.Equal(t, context.Canceled, err)
+
+	items, err := buffcomp.RetrieveFromQueueCtx(ctx, 10)
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, items, 0)
+
+	_, err = NewWithStoreCtx(ctx, NewMemoryStore(), 0)
+	assert.Equal(t, context.Canceled, err)
+
+	//Nothing was lost
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "test1", items[0].Key)
+}
+
+func Test_WaitAndRetrieve(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 100*time.Millisecond)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+
+	start := time.Now()
+	items, err := buffcomp.WaitAndRetrieve(context.Background(), 10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	items, err = buffcomp.WaitAndRetrieve(ctx, 10)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, items, 0)
+}
@@ -0,0 +1,200 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	DeadLetterKeyPrefix = "dead_letter:%s"
+
+	errAttemptsExhausted = errors.New("attempts exhausted")
+	errStopScan          = errors.New("stop scan")
+)
+
+// Backoff returns how long to hold an item back after its attempts-th
+// failure.
+type Backoff func(attempts int) time.Duration
+
+// ExponentialBackoff doubles the delay on every failure starting from base,
+// never exceeding max.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempts int) time.Duration {
+		delay := base
+		for i := 1; i < attempts && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// WithRetry controls how items released with Nack are retried. Every Nack
+// counts as a failed attempt and holds the item back for backoff(attempts).
+// Once an item has failed maxAttempts times it is moved to the dead-letter
+// keyspace instead. A maxAttempts of zero retries forever.
+func WithRetry(maxAttempts int, backoff Backoff) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.maxAttempts = maxAttempts
+		b.backoff = backoff
+	}
+}
+
+// DeadLetters returns up to limit items from the dead-letter keyspace, or
+// all of them when limit is zero. Keys are returned without the dead-letter
+// prefix.
+func (b *BufferCompactor) DeadLetters(limit int) ([]*StorageItem, error) {
+	var items []*StorageItem
+	prefix := deadLetterKey("")
+	err := b.store.ScanPrefix(prefix, func(key string, value []byte) error {
+		rec, err := decodeRecord(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		rec.value = append([]byte(nil), rec.value...)
+		items = append(items, newStorageItem(strings.TrimPrefix(key, prefix), rec))
+		if limit > 0 && len(items) >= limit {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// ReplayDeadLetter moves the dead letter stored for key back into the queue
+// as a new write with its attempts reset, in a single store operation. The
+// write is never dropped for dedupe, as its UniqueID was already seen when it
+// was first stored. It never waits for space: when the queue is full the
+// dead letter is kept and the capacity error is returned.
+func (b *BufferCompactor) ReplayDeadLetter(key string) error {
+	dlqKey := deadLetterKey(key)
+	var size int64
+	found := false
+	err := b.store.ScanPrefix(dlqKey, func(k string, value []byte) error {
+		if k != dlqKey {
+			return nil
+		}
+		found = true
+		rec, err := decodeRecord(value)
+		size = int64(len(rec.value))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	b.mu.Lock()
+	res, err := b.tryAdmit(key, size)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var rec record
+	err = b.store.PutFrom(dlqKey, func(existing []byte) (StoreEntry, error) {
+		dead, err := decodeRecord(existing)
+		if err != nil {
+			return StoreEntry{}, err
+		}
+		item := StorageItem{Key: key, Value: dead.value, UniqueID: dead.uniqueID, Headers: dead.headers}
+		entry := b.storeEntry(item, &rec, time.Now())
+		entry.UniqueID, entry.DedupeKey = "", ""
+		return entry, nil
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.release(res)
+	if err != nil {
+		return err
+	}
+	b.buffer(key, rec)
+	return nil
+}
+
+// PurgeDeadLetter deletes the dead letter stored for key.
+func (b *BufferCompactor) PurgeDeadLetter(key string) error {
+	return b.store.Delete(deadLetterKey(key))
+}
+
+// PurgeDeadLetters deletes every dead letter and returns how many were
+// removed.
+func (b *BufferCompactor) PurgeDeadLetters() (int, error) {
+	var keys []string
+	err := b.store.ScanPrefix(deadLetterKey(""), func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := b.store.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// deadLetter moves the record under key, if it is still leased with token, to
+// the dead-letter keyspace.
+func (b *BufferCompactor) deadLetter(key string, token int64, now time.Time) error {
+	return b.store.Move(itemKey(key), deadLetterKey(key), func(existing []byte) ([]byte, error) {
+		rec, err := decodeRecord(existing)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLeasedRecord(rec, token); err != nil {
+			return nil, err
+		}
+		rec.attempts++
+		rec.score = toScore(now)
+		rec.leased = false
+		return encodeRecord(rec), nil
+	})
+}
+
+func deadLetterKey(key string) string {
+	return fmt.Sprintf(DeadLetterKeyPrefix, key)
+}
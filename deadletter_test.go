@@ -0,0 +1,162 @@
+package buffercompact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, 10*time.Second)
+
+	assert.Equal(t, 1*time.Second, backoff(1))
+	assert.Equal(t, 2*time.Second, backoff(2))
+	assert.Equal(t, 4*time.Second, backoff(3))
+	assert.Equal(t, 8*time.Second, backoff(4))
+	assert.Equal(t, 10*time.Second, backoff(5))
+	assert.Equal(t, 10*time.Second, backoff(50))
+}
+
+func Test_RetryBackoffCase(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0,
+		WithLease(time.Minute), WithRetry(0, ExponentialBackoff(time.Minute, time.Hour)))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	assert.Nil(t, buffcomp.Nack("test1", items[0].LeaseToken))
+
+	//Held back by the backoff
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+
+	node := buffcomp.sortedSet.GetByKey("test1")
+	assert.NotNil(t, node)
+	assert.InDelta(t, toScore(time.Now().Add(time.Minute)), int64(node.Score()), 10)
+}
+
+func Test_DeadLetterCase(t *testing.T) {
+	store := NewMemoryStore()
+	noBackoff := func(int) time.Duration { return 0 }
+	buffcomp, err := NewWithStore(store, 0, WithLease(time.Minute), WithRetry(2, noBackoff))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, 0, items[0].Attempts)
+	assert.Nil(t, buffcomp.Nack("test1", items[0].LeaseToken))
+
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, 1, items[0].Attempts)
+	assert.Nil(t, buffcomp.Nack("test1", items[0].LeaseToken))
+
+	//Second failure moves the item to the dead-letter keyspace
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+
+	dead, err := buffcomp.DeadLetters(0)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, "test1", dead[0].Key)
+	assert.Equal(t, []byte("testValue1"), dead[0].Value)
+	assert.Equal(t, 2, dead[0].Attempts)
+
+	//Dead letters are not loaded as queue items
+	buffcomp2, err := NewWithStore(store, 0, WithLease(time.Minute), WithRetry(2, noBackoff))
+	assert.Nil(t, err)
+	items, err = buffcomp2.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+
+	assert.Nil(t, buffcomp2.ReplayDeadLetter("test1"))
+	dead, err = buffcomp2.DeadLetters(0)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 0)
+
+	items, err = buffcomp2.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+	assert.Equal(t, 0, items[0].Attempts)
+}
+
+func Test_PurgeDeadLetters(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Minute), WithRetry(1, nil))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	for _, item := range items {
+		assert.Nil(t, buffcomp.Nack(item.Key, item.LeaseToken))
+	}
+
+	dead, err := buffcomp.DeadLetters(2)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 2)
+
+	assert.Nil(t, buffcomp.PurgeDeadLetter("test1"))
+	count, err := buffcomp.PurgeDeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	dead, err = buffcomp.DeadLetters(0)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 0)
+}
+
+func Test_ReplayDeadLetter_AutoDedupe(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Minute), WithRetry(1, nil), WithAutoDedupe(nil))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Nil(t, buffcomp.Nack("test1", items[0].LeaseToken))
+
+	//the replayed value hashes to the id already in the key's dedupe marker
+	assert.Nil(t, buffcomp.ReplayDeadLetter("test1"))
+	dead, err := buffcomp.DeadLetters(0)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 0)
+
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+	assert.Equal(t, XXHash([]byte("testValue1")), items[0].UniqueID)
+}
+
+func Test_ReplayDeadLetter_FullQueue(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Minute), WithRetry(1, nil),
+		WithMaxValueCount(1), WithOverflowPolicy(OverflowBlock))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Nil(t, buffcomp.Nack("test1", items[0].LeaseToken))
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+
+	//the replay does not wait for space and keeps the dead letter
+	assert.Equal(t, ErrMaxValueCount, buffcomp.ReplayDeadLetter("test1"))
+	dead, err := buffcomp.DeadLetters(0)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+
+	assert.Equal(t, ErrNotFound, buffcomp.ReplayDeadLetter("test3"))
+}
@@ -0,0 +1,147 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+var (
+	GlobalDedupeKeyPrefix = "unique_id:%s"
+)
+
+// DedupeScope decides which writes a UniqueID is compared against.
+type DedupeScope int
+
+const (
+	// DedupePerKey drops a write when its UniqueID matches one of the latest
+	// ids written to the same key.
+	DedupePerKey DedupeScope = iota
+	// DedupeGlobal drops a write when its UniqueID was written to any key.
+	DedupeGlobal
+)
+
+// WithDedupeScope selects which writes UniqueIDs are compared against. The
+// default is DedupePerKey.
+func WithDedupeScope(scope DedupeScope) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.dedupeScope = scope
+	}
+}
+
+// WithDedupeWindow makes DedupePerKey remember the last n UniqueIDs of every
+// key instead of only the latest one.
+func WithDedupeWindow(n int) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.dedupeWindow = n
+	}
+}
+
+// DedupeHashFunc derives a UniqueID from the hashed content of an item.
+type DedupeHashFunc func(data []byte) string
+
+// XXHash is the default DedupeHashFunc.
+func XXHash(data []byte) string {
+	return strconv.FormatUint(xxhash.Sum64(data), 16)
+}
+
+// WithAutoDedupe gives items stored without a UniqueID one derived from a
+// hash of their value, so that writes repeating the same payload are dropped.
+// A nil hash uses XXHash.
+func WithAutoDedupe(hash DedupeHashFunc) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		if hash == nil {
+			hash = XXHash
+		}
+		b.autoDedupe = hash
+	}
+}
+
+// WithAutoDedupeHeaders makes WithAutoDedupe hash the named headers of an
+// item instead of its value.
+func WithAutoDedupeHeaders(names ...string) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.autoDedupeHeaders = names
+	}
+}
+
+// uniqueID returns the UniqueID of item, or the one WithAutoDedupe derives
+// for it.
+func (b *BufferCompactor) uniqueID(item StorageItem) string {
+	if item.UniqueID == "" && b.autoDedupe != nil {
+		return b.autoUniqueID(item)
+	}
+	return item.UniqueID
+}
+
+// autoUniqueID derives the UniqueID of an item stored without one.
+func (b *BufferCompactor) autoUniqueID(item StorageItem) string {
+	if len(b.autoDedupeHeaders) == 0 {
+		return b.autoDedupe(item.Value)
+	}
+
+	var data []byte
+	for _, name := range b.autoDedupeHeaders {
+		value, ok := item.Headers[name]
+		if !ok {
+			data = append(data, 0)
+			continue
+		}
+		data = append(data, 1)
+		data = appendString(data, string(value))
+	}
+	return b.autoDedupe(data)
+}
+
+// setDedupe fills in the dedupe fields of entry, which writes item.
+func (b *BufferCompactor) setDedupe(entry *StoreEntry, item StorageItem) {
+	if item.UniqueID == "" {
+		return
+	}
+
+	if b.filter != nil {
+		//the dedupe filter stands in for the per id markers
+		return
+	}
+
+	entry.UniqueID = item.UniqueID
+	if b.dedupeScope == DedupeGlobal {
+		entry.DedupeKey = fmt.Sprintf(GlobalDedupeKeyPrefix, item.UniqueID)
+	} else {
+		entry.DedupeKey = fmt.Sprintf(DedupeKeyPrefix, item.Key)
+		entry.DedupeWindow = b.dedupeWindow
+	}
+	if b.dedupeDuration != nil {
+		entry.DedupeTTL = *b.dedupeDuration
+	}
+}
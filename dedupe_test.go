@@ -0,0 +1,136 @@
+package buffercompact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DedupeDuration(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithDedupeDuration(50*time.Millisecond))
+	assert.Nil(t, err)
+	assert.Nil(t, buffcomp.ttlDuration)
+
+	status, _ := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Stored, status)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Deduplicated, status)
+
+	//The marker expires but the item does not
+	time.Sleep(100 * time.Millisecond)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Compacted, status)
+}
+
+func Test_DedupeWindow(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithDedupeWindow(2))
+	assert.Nil(t, err)
+
+	for _, id := range []string{"id1", "id2", "id1", "id2", "id3", "id1"} {
+		buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte(id), UniqueID: id})
+	}
+	item, err := buffcomp.RemoveFromDB("test1")
+	assert.Nil(t, err)
+	//Repeats within the last two ids were dropped, id1 was stored again
+	//once id2 and id3 had pushed it out
+	assert.Equal(t, []byte("id1"), item.Value)
+	assert.Equal(t, 4, item.Writes())
+
+	//Other keys keep their own window
+	status, _ := buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("id3"), UniqueID: "id3"})
+	assert.Equal(t, Stored, status)
+}
+
+func Test_DedupeGlobal(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithDedupeScope(DedupeGlobal))
+	assert.Nil(t, err)
+
+	status, _ := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Stored, status)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Deduplicated, status)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2"), UniqueID: "id2"})
+	assert.Equal(t, Compacted, status)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Deduplicated, status)
+}
+
+func Test_dedupeMarker(t *testing.T) {
+	marker, duplicate := dedupeMarker(nil, "id1", 1)
+	assert.False(t, duplicate)
+	assert.Equal(t, []byte("id1"), marker)
+
+	//Markers written with a window of one are read by larger windows
+	marker, duplicate = dedupeMarker(marker, "id2", 2)
+	assert.False(t, duplicate)
+	_, duplicate = dedupeMarker(marker, "id1", 2)
+	assert.True(t, duplicate)
+
+	marker, _ = dedupeMarker(marker, "id3", 2)
+	_, duplicate = dedupeMarker(marker, "id1", 2)
+	assert.False(t, duplicate)
+	_, duplicate = dedupeMarker(marker, "id2", 2)
+	assert.True(t, duplicate)
+}
+
+func Test_AutoDedupe(test *testing.T) {
+	cases := map[string]struct {
+		opts     []BufferCompactorOption
+		items    []StorageItem
+		expected []StoreStatus
+	}{
+		"Value": {
+			opts: []BufferCompactorOption{WithAutoDedupe(nil)},
+			items: []StorageItem{
+				{Key: "test1", Value: []byte("testValue1")},
+				{Key: "test1", Value: []byte("testValue1")},
+				{Key: "test1", Value: []byte("testValue2")},
+				{Key: "test1", Value: []byte("testValue2"), UniqueID: "id1"},
+			},
+			expected: []StoreStatus{Stored, Deduplicated, Compacted, Compacted},
+		},
+		"Headers": {
+			opts: []BufferCompactorOption{WithAutoDedupe(nil), WithAutoDedupeHeaders("offset")},
+			items: []StorageItem{
+				{Key: "test1", Value: []byte("testValue1"), Headers: map[string][]byte{"offset": []byte("1")}},
+				{Key: "test1", Value: []byte("testValue2"), Headers: map[string][]byte{"offset": []byte("1")}},
+				{Key: "test1", Value: []byte("testValue2"), Headers: map[string][]byte{"offset": []byte("2")}},
+			},
+			expected: []StoreStatus{Stored, Deduplicated, Compacted},
+		},
+	}
+
+	for name, c := range cases {
+		test.Run(name, func(t *testing.T) {
+			buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, c.opts...)
+			assert.Nil(t, err)
+
+			for i, item := range c.items {
+				status, err := buffcomp.StoreToQueue(item)
+				assert.Nil(t, err)
+				assert.Equal(t, c.expected[i], status, "item %d", i)
+			}
+		})
+	}
+}
+
+func Test_AutoDedupe_HashesOnce(t *testing.T) {
+	hashes := 0
+	hash := func(data []byte) string {
+		hashes++
+		return XXHash(data)
+	}
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithAutoDedupe(hash), WithDedupeScope(DedupeGlobal),
+		WithDedupeFilter(DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Hour}))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	assert.Equal(t, 1, hashes)
+
+	buffcomp.StoreBatch([]StorageItem{
+		{Key: "test2", Value: []byte("testValue2")},
+		{Key: "test3", Value: []byte("testValue3")},
+	})
+	assert.Equal(t, 3, hashes)
+}
@@ -0,0 +1,415 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+var (
+	ErrDedupeFilterScope = errors.New("dedupe filter requires DedupeGlobal")
+)
+
+// dedupeFilterKey is the metadata key of the dedupe filter snapshot. The
+// snapshot itself is split into chunks stored under dedupeFilterChunkKey, so
+// that no single value outgrows what the store accepts.
+const dedupeFilterKey = "dedupe_filter"
+
+const (
+	dedupeFilterVersion1 byte = 1 //the whole snapshot in one value
+	dedupeFilterVersion2 byte = 2 //the snapshot in chunks
+)
+
+const (
+	dedupeFilterChunkSize = 512 << 10
+	//how long to wait before retrying a snapshot that failed
+	dedupeFilterSaveRetry = time.Minute
+)
+
+// DedupeFilterOptions configures the filter set with WithDedupeFilter.
+type DedupeFilterOptions struct {
+	Capacity          int           // ids expected per window, defaults to 1,000,000
+	FalsePositiveRate float64       // chance a new id is taken for a duplicate, defaults to 0.001
+	Window            time.Duration // how long ids are remembered at least, defaults to 24h
+	SnapshotInterval  time.Duration // how often the filter is snapshotted between rotations, defaults to 1h, negative disables
+}
+
+// DedupeFilterStats counts the ids checked against the dedupe filter.
+type DedupeFilterStats struct {
+	Hits           uint64 // ids the filter had seen
+	Misses         uint64 // ids the filter had not seen
+	Rotations      uint64
+	SnapshotErrors uint64 // automatic snapshots that failed, they are retried a minute later
+}
+
+// WithDedupeFilter replaces the per id dedupe markers of DedupeGlobal with an
+// in-memory Bloom filter of the ids stored recently. Ids the filter has seen
+// are dropped, including the FalsePositiveRate share of new ids it mistakes
+// for seen ones. New fails with ErrDedupeFilterScope unless
+// WithDedupeScope(DedupeGlobal) is set too.
+//
+// Ids are remembered for between one and two windows. The filter is
+// snapshotted to the store whenever it rotates, every SnapshotInterval and by
+// SaveDedupeFilter, and loaded again by New. Automatic snapshots are taken by
+// the write that finds one due, and a failed one does not fail that write.
+func WithDedupeFilter(opts DedupeFilterOptions) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		if opts.Capacity <= 0 {
+			opts.Capacity = 1000000
+		}
+		if opts.FalsePositiveRate <= 0 || opts.FalsePositiveRate >= 1 {
+			opts.FalsePositiveRate = 0.001
+		}
+		if opts.Window <= 0 {
+			opts.Window = 24 * time.Hour
+		}
+		if opts.SnapshotInterval == 0 {
+			opts.SnapshotInterval = time.Hour
+		}
+		b.filter = newDedupeFilter(opts, time.Now())
+	}
+}
+
+// DedupeFilterStats returns the counters of the filter set with
+// WithDedupeFilter.
+func (b *BufferCompactor) DedupeFilterStats() DedupeFilterStats {
+	if b.filter == nil {
+		return DedupeFilterStats{}
+	}
+
+	b.filter.mu.Lock()
+	defer b.filter.mu.Unlock()
+	return b.filter.stats
+}
+
+// SaveDedupeFilter snapshots the filter set with WithDedupeFilter to the
+// store. Ids added since the last snapshot are forgotten on restart unless it
+// is called before shutting down.
+func (b *BufferCompactor) SaveDedupeFilter() error {
+	if b.filter == nil {
+		return nil
+	}
+	f := b.filter
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+
+	f.mu.Lock()
+	snapshot := f.encode()
+	f.mu.Unlock()
+
+	//the chunks of a new snapshot go under a new generation, so that the
+	//previous snapshot stays whole until the header points at this one
+	gen := f.savedGen + 1
+	var chunks int
+	for ; len(snapshot) > 0; chunks++ {
+		n := len(snapshot)
+		if n > dedupeFilterChunkSize {
+			n = dedupeFilterChunkSize
+		}
+		if _, err := b.store.Put(StoreEntry{Key: metaKey(dedupeFilterChunkKey(gen, chunks)), Value: snapshot[:n]}); err != nil {
+			return err
+		}
+		snapshot = snapshot[n:]
+	}
+
+	header := []byte{dedupeFilterVersion2}
+	header = appendUint64(header, gen)
+	header = appendUint32(header, uint32(chunks))
+	if _, err := b.store.Put(StoreEntry{Key: metaKey(dedupeFilterKey), Value: header}); err != nil {
+		return err
+	}
+
+	//chunks left behind by a failed delete are removed on the next load
+	for i := 0; i < f.savedChunks; i++ {
+		b.store.Delete(metaKey(dedupeFilterChunkKey(f.savedGen, i)))
+	}
+	f.savedGen, f.savedChunks = gen, chunks
+
+	f.mu.Lock()
+	f.scheduleSave(time.Now())
+	f.mu.Unlock()
+	return nil
+}
+
+// claimUniqueID reports whether the dedupe filter has seen id, rotating it
+// first when its window has passed. An id that was not seen is claimed, so
+// writes of the same id count as seen until the claim ends with
+// finishUniqueIDs. A snapshot that is due is taken before returning.
+func (b *BufferCompactor) claimUniqueID(id string, now time.Time) bool {
+	f := b.filter
+	f.mu.Lock()
+	if f.rotate(now) {
+		f.nextSave = now
+	}
+	seen := f.contains(id) || f.pending[id]
+	if seen {
+		f.stats.Hits++
+	} else {
+		f.stats.Misses++
+		f.pending[id] = true
+	}
+	//only one write takes a due snapshot
+	save := !f.saving && !f.nextSave.IsZero() && !now.Before(f.nextSave)
+	f.saving = f.saving || save
+	f.mu.Unlock()
+
+	if save {
+		err := b.SaveDedupeFilter()
+		f.mu.Lock()
+		f.saving = false
+		if err != nil {
+			f.stats.SnapshotErrors++
+			f.nextSave = now.Add(dedupeFilterSaveRetry)
+		}
+		f.mu.Unlock()
+	}
+	return seen
+}
+
+// finishUniqueIDs ends the claims on ids, adding them to the dedupe filter
+// when their items were stored.
+func (b *BufferCompactor) finishUniqueIDs(stored bool, ids ...string) {
+	b.filter.mu.Lock()
+	defer b.filter.mu.Unlock()
+
+	for _, id := range ids {
+		delete(b.filter.pending, id)
+		if stored {
+			b.filter.current.add(id)
+		}
+	}
+}
+
+// loadDedupeFilter restores the filter from its snapshot, unless there is
+// none, it is incomplete or it was taken with other options. Chunks that are
+// not part of the snapshot are deleted.
+func (b *BufferCompactor) loadDedupeFilter() error {
+	key := metaKey(dedupeFilterKey)
+	var header []byte
+	chunks := make(map[string][]byte)
+	err := b.store.ScanPrefix(key, func(k string, value []byte) error {
+		if k == key {
+			header = append([]byte(nil), value...)
+		} else {
+			chunks[k] = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f := b.filter
+	var snapshot []byte
+	switch {
+	case len(header) > 0 && header[0] == dedupeFilterVersion1:
+		snapshot = header[1:]
+	case len(header) == 13 && header[0] == dedupeFilterVersion2:
+		gen := binary.LittleEndian.Uint64(header[1:])
+		count := int(binary.LittleEndian.Uint32(header[9:]))
+		for i := 0; i < count; i++ {
+			chunkKey := metaKey(dedupeFilterChunkKey(gen, i))
+			chunk, ok := chunks[chunkKey]
+			if !ok {
+				snapshot = nil
+				break
+			}
+			snapshot = append(snapshot, chunk...)
+			delete(chunks, chunkKey)
+		}
+		f.savedGen, f.savedChunks = gen, count
+	}
+
+	for k := range chunks {
+		if err := b.store.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if snapshot != nil {
+		f.decode(snapshot)
+	}
+	f.scheduleSave(time.Now())
+	return nil
+}
+
+// dedupeFilterChunkKey is the metadata key of chunk i of the snapshot
+// generation gen.
+func dedupeFilterChunkKey(gen uint64, i int) string {
+	return fmt.Sprintf("%s:%d:%d", dedupeFilterKey, gen, i)
+}
+
+// dedupeFilter remembers ids in two generations of Bloom filters. New ids go
+// to current, which replaces previous once the window has passed. Ids whose
+// items are being written are held in pending, as a Bloom filter cannot
+// forget an id whose write failed.
+type dedupeFilter struct {
+	mu        sync.Mutex
+	window    time.Duration
+	rotatedAt time.Time
+	current   *bloomFilter
+	previous  *bloomFilter
+	pending   map[string]bool
+	stats     DedupeFilterStats
+
+	//when the next automatic snapshot is due, zero for never
+	interval time.Duration
+	nextSave time.Time
+	saving   bool
+
+	//saveMu serializes snapshots, which replace the chunks of savedGen
+	saveMu      sync.Mutex
+	savedGen    uint64
+	savedChunks int
+}
+
+func newDedupeFilter(opts DedupeFilterOptions, now time.Time) *dedupeFilter {
+	//the standard sizing for n items at false positive rate p
+	n := float64(opts.Capacity)
+	m := math.Ceil(-n * math.Log(opts.FalsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Max(1, math.Round(m/n*math.Ln2)))
+
+	f := &dedupeFilter{
+		window:    opts.Window,
+		rotatedAt: now,
+		current:   newBloomFilter(uint64(m), k),
+		previous:  newBloomFilter(uint64(m), k),
+		pending:   make(map[string]bool),
+		interval:  opts.SnapshotInterval,
+	}
+	f.scheduleSave(now)
+	return f
+}
+
+// scheduleSave sets when the next periodic snapshot after now is due. The
+// caller must hold f.mu.
+func (f *dedupeFilter) scheduleSave(now time.Time) {
+	f.nextSave = time.Time{}
+	if f.interval > 0 {
+		f.nextSave = now.Add(f.interval)
+	}
+}
+
+func (f *dedupeFilter) rotate(now time.Time) bool {
+	if now.Sub(f.rotatedAt) < f.window {
+		return false
+	}
+	f.previous = f.current
+	f.current = newBloomFilter(f.previous.m, f.previous.k)
+	f.rotatedAt = now
+	f.stats.Rotations++
+	return true
+}
+
+func (f *dedupeFilter) contains(id string) bool {
+	return f.current.contains(id) || f.previous.contains(id)
+}
+
+// encode lays the filter out as
+//
+//	rotated at (8) | bits (8) | hashes (4) | current | previous
+//
+// The snapshot header in front of it is written by SaveDedupeFilter.
+func (f *dedupeFilter) encode() []byte {
+	b := make([]byte, 0, 20+16*len(f.current.bits))
+	b = appendUint64(b, uint64(toScore(f.rotatedAt)))
+	b = appendUint64(b, f.current.m)
+	b = appendUint32(b, uint32(f.current.k))
+	for _, filter := range []*bloomFilter{f.current, f.previous} {
+		for _, word := range filter.bits {
+			b = appendUint64(b, word)
+		}
+	}
+	return b
+}
+
+func (f *dedupeFilter) decode(b []byte) {
+	words := len(f.current.bits)
+	if len(b) != 20+16*words {
+		return
+	}
+	if binary.LittleEndian.Uint64(b[8:]) != f.current.m || int(binary.LittleEndian.Uint32(b[16:])) != f.current.k {
+		return
+	}
+
+	f.rotatedAt = fromScore(int64(binary.LittleEndian.Uint64(b)))
+	b = b[20:]
+	for _, filter := range []*bloomFilter{f.current, f.previous} {
+		for i := range filter.bits {
+			filter.bits[i] = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		}
+	}
+}
+
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    int    // number of hashes
+}
+
+func newBloomFilter(m uint64, k int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (f *bloomFilter) add(id string) {
+	h1, h2 := bloomHashes(id)
+	for i := 0; i < f.k; i++ {
+		bit := (h1 + uint64(i)*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) contains(id string) bool {
+	h1, h2 := bloomHashes(id)
+	for i := 0; i < f.k; i++ {
+		bit := (h1 + uint64(i)*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives the two hashes combined into the k bit positions of
+// id.
+func bloomHashes(id string) (uint64, uint64) {
+	h := xxhash.Sum64String(id)
+	return h & math.MaxUint32, h>>32 | 1
+}
@@ -0,0 +1,205 @@
+package buffercompact
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DedupeFilter(t *testing.T) {
+	store := NewMemoryStore()
+	opts := DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Hour}
+	buffcomp, err := NewWithStore(store, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+
+	status, _ := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Stored, status)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Deduplicated, status)
+
+	results := buffcomp.StoreBatch([]StorageItem{
+		{Key: "test3", Value: []byte("testValue3"), UniqueID: "id1"},
+		{Key: "test3", Value: []byte("testValue3"), UniqueID: "id3"},
+		{Key: "test4", Value: []byte("testValue3"), UniqueID: "id3"},
+	})
+	assert.Equal(t, []StoreResult{{Status: Deduplicated}, {Status: Stored}, {Status: Deduplicated}}, results)
+	assert.Equal(t, DedupeFilterStats{Hits: 3, Misses: 2}, buffcomp.DedupeFilterStats())
+
+	//No per id markers are written
+	var markers int
+	store.ScanPrefix(fmt.Sprintf(GlobalDedupeKeyPrefix, ""), func(key string, value []byte) error {
+		markers++
+		return nil
+	})
+	assert.Equal(t, 0, markers)
+
+	//The filter survives a restart once saved
+	assert.Nil(t, buffcomp.SaveDedupeFilter())
+	buffcomp, err = NewWithStore(store, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test5", Value: []byte("testValue5"), UniqueID: "id3"})
+	assert.Equal(t, Deduplicated, status)
+}
+
+func Test_DedupeFilterRotation(t *testing.T) {
+	filter := newDedupeFilter(DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Minute}, time.Now())
+	filter.current.add("id1")
+
+	//Ids are kept for one more window after a rotation
+	now := time.Now().Add(time.Minute)
+	assert.True(t, filter.rotate(now))
+	assert.True(t, filter.contains("id1"))
+	assert.True(t, filter.rotate(now.Add(time.Minute)))
+	assert.False(t, filter.contains("id1"))
+	assert.Equal(t, uint64(2), filter.stats.Rotations)
+}
+
+func Test_DedupeFilterFalsePositiveRate(t *testing.T) {
+	filter := newDedupeFilter(DedupeFilterOptions{Capacity: 10000, FalsePositiveRate: 0.01, Window: time.Hour}, time.Now())
+	for i := 0; i < 10000; i++ {
+		filter.current.add(fmt.Sprintf("id%d", i))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.contains(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 200)
+}
+
+func Test_DedupeFilterRequiresGlobalScope(t *testing.T) {
+	opts := DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Hour}
+	_, err := NewWithStore(NewMemoryStore(), time.Hour, WithAutoDedupe(nil), WithDedupeFilter(opts))
+	assert.Equal(t, ErrDedupeFilterScope, err)
+}
+
+func Test_DedupeFilterConcurrentStores(t *testing.T) {
+	opts := DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Hour}
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	statuses := make(chan StoreStatus, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, err := buffcomp.StoreToQueue(StorageItem{Key: fmt.Sprintf("test%d", i), Value: []byte("testValue"), UniqueID: "id1"})
+			assert.Nil(t, err)
+			statuses <- status
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	var stored int
+	for status := range statuses {
+		if status == Stored {
+			stored++
+		}
+	}
+	assert.Equal(t, 1, stored)
+}
+
+// failingPutStore fails every Put of a key starting with failPrefix while
+// fail is set
+type failingPutStore struct {
+	*MemoryStore
+	fail       bool
+	failPrefix string
+}
+
+func (s *failingPutStore) Put(entry StoreEntry) (bool, error) {
+	if s.fail && strings.HasPrefix(entry.Key, s.failPrefix) {
+		return false, errors.New("put failed")
+	}
+	return s.MemoryStore.Put(entry)
+}
+
+func Test_DedupeFilterForgetsFailedWrites(t *testing.T) {
+	store := &failingPutStore{MemoryStore: NewMemoryStore()}
+	opts := DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Hour}
+	buffcomp, err := NewWithStore(store, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+
+	store.fail = true
+
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.EqualError(t, err, "put failed")
+	assert.Equal(t, Rejected, status)
+
+	//the retry is not mistaken for a duplicate
+	store.fail = false
+	status, err = buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+}
+
+func Test_DedupeFilterLargeSnapshot(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	//the default filter is larger than a single badger value may be
+	opts := DedupeFilterOptions{}
+	buffcomp, err := New(db, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+	status, _ := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Equal(t, Stored, status)
+	assert.Nil(t, buffcomp.SaveDedupeFilter())
+	assert.Nil(t, buffcomp.SaveDedupeFilter())
+	assert.Greater(t, buffcomp.filter.savedChunks, 1)
+
+	//only the chunks of the latest snapshot are kept
+	var keys int
+	NewBadgerStore(db).ScanPrefix(metaKey(dedupeFilterKey), func(key string, value []byte) error {
+		keys++
+		return nil
+	})
+	assert.Equal(t, 1+buffcomp.filter.savedChunks, keys)
+
+	buffcomp, err = New(db, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+	status, _ = buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2"), UniqueID: "id1"})
+	assert.Equal(t, Deduplicated, status)
+}
+
+func Test_DedupeFilterSnapshotFailureKeepsWrite(t *testing.T) {
+	store := &failingPutStore{MemoryStore: NewMemoryStore(), failPrefix: metaKey("")}
+	opts := DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: 20 * time.Millisecond}
+	buffcomp, err := NewWithStore(store, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+
+	//the write that rotates the filter is stored even though the snapshot fails
+	store.fail = true
+	time.Sleep(30 * time.Millisecond)
+	status, err := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Stored, status)
+	assert.Equal(t, uint64(1), buffcomp.DedupeFilterStats().SnapshotErrors)
+}
+
+func Test_DedupeFilterPeriodicSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	opts := DedupeFilterOptions{Capacity: 1000, FalsePositiveRate: 0.01, Window: time.Hour, SnapshotInterval: 20 * time.Millisecond}
+	buffcomp, err := NewWithStore(store, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), UniqueID: "id1"})
+	time.Sleep(30 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2"), UniqueID: "id2"})
+
+	//id1 was snapshotted without SaveDedupeFilter
+	buffcomp, err = NewWithStore(store, time.Hour, WithDedupeScope(DedupeGlobal), WithDedupeFilter(opts))
+	assert.Nil(t, err)
+	status, _ := buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3"), UniqueID: "id1"})
+	assert.Equal(t, Deduplicated, status)
+}
@@ -0,0 +1,152 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"context"
+	"time"
+
+	"github.com/parkerroan/buffercompact/sortedset"
+)
+
+// janitorChunkSize is how many keys the janitor checks per lock of the
+// sortedset.
+const janitorChunkSize = 1000
+
+// WithOnExpire calls fn with every key that is dropped from the queue because
+// its record expired, see WithTTL. fn is called without any locks held.
+func WithOnExpire(fn func(key string)) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.onExpire = fn
+	}
+}
+
+// ExpiredCount returns how many keys have been dropped from the queue because
+// their record expired before it was released.
+func (b *BufferCompactor) ExpiredCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.expiredCount
+}
+
+// RunJanitor calls RemoveExpired every interval until ctx is cancelled, so
+// keys whose records expired do not pile up in memory until they are due.
+func (b *BufferCompactor) RunJanitor(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := b.RemoveExpired(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RemoveExpired drops every queued key whose record has expired and returns
+// how many were dropped.
+func (b *BufferCompactor) RemoveExpired(ctx context.Context) (int, error) {
+	b.mu.Lock()
+	nodes := b.sortedSet.GetByRankRange(1, -1, false)
+	b.mu.Unlock()
+
+	removed := 0
+	for start := 0; start < len(nodes); start += janitorChunkSize {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		end := start + janitorChunkSize
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		expired, err := b.removeExpiredKeys(nodes[start:end])
+		if err != nil {
+			return removed, err
+		}
+		b.expire(expired)
+		removed += len(expired)
+	}
+	return removed, nil
+}
+
+// removeExpiredKeys removes the keys of nodes that are still queued but no
+// longer have a record. The check runs under b.mu so that a key stored again
+// in the meantime is never dropped.
+func (b *BufferCompactor) removeExpiredKeys(nodes []*sortedset.SortedSetNode) ([]string, error) {
+	keys := make([]string, len(nodes))
+	storeKeys := make([]string, len(nodes))
+	for i := range nodes {
+		keys[i] = nodes[i].Key()
+		storeKeys[i] = itemKey(keys[i])
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exists, err := b.store.Exists(storeKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for i, key := range keys {
+		if !exists[i] {
+			if node := b.sortedSet.Remove(key); node != nil {
+				b.dequeued([]*sortedset.SortedSetNode{node})
+				expired = append(expired, key)
+			}
+		}
+	}
+	return expired, nil
+}
+
+// expire counts keys as expired and passes them to the WithOnExpire
+// callback. The caller must not hold b.mu.
+func (b *BufferCompactor) expire(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.expiredCount += len(keys)
+	b.mu.Unlock()
+
+	if b.onExpire != nil {
+		for _, key := range keys {
+			b.onExpire(key)
+		}
+	}
+}
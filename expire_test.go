@@ -0,0 +1,44 @@
+package buffercompact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RetrieveSkipsExpiredKeys(t *testing.T) {
+	var expired []string
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithTTL(50*time.Millisecond), WithOnExpire(func(key string) {
+		expired = append(expired, key)
+	}))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	time.Sleep(100 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "test2", items[0].Key)
+	assert.Equal(t, []string{"test1"}, expired)
+	assert.Equal(t, 1, buffcomp.ExpiredCount())
+}
+
+func Test_RemoveExpired(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour, WithTTL(50*time.Millisecond))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	time.Sleep(100 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+
+	removed, err := buffcomp.RemoveExpired(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Nil(t, buffcomp.sortedSet.GetByKey("test1"))
+	assert.NotNil(t, buffcomp.sortedSet.GetByKey("test2"))
+	assert.Equal(t, 1, buffcomp.ExpiredCount())
+}
@@ -3,13 +3,13 @@ module github.com/parkerroan/buffercompact
 go 1.17
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/dgraph-io/badger/v3 v3.2103.2
 	github.com/stretchr/testify v1.7.0
 )
 
 require (
 	github.com/cespare/xxhash v1.1.0 // indirect
-	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgraph-io/ristretto v0.1.0 // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
@@ -0,0 +1,162 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ItemKeyPrefix = "item:%s"
+	MetaKeyPrefix = "meta:%s"
+)
+
+// keyLayoutVersion is stored under the layoutVersionKey metadata key once a
+// store uses the prefixed key layout. recordVersionKey is set once every
+// record has been rewritten in the current record version.
+const (
+	keyLayoutVersion = "1"
+	layoutVersionKey = "layout_version"
+)
+
+var recordVersionKey = fmt.Sprintf("record_version:%d", currentRecordVersion)
+
+// MigrateKeyLayout moves queue items that were stored under their raw key,
+// before items had their own keyspace, to ItemKeyPrefix and returns how many
+// were moved. Keys in the item, dedupe, dead-letter, quarantine and metadata
+// keyspaces and the keys of named queues are left alone. Moved items keep
+// their expiry.
+//
+// New runs the migration on stores that have not been migrated yet. It is
+// safe to run again if it was interrupted.
+func MigrateKeyLayout(store Store) (int, error) {
+	prefixes := []string{itemKey(""), metaKey(""), deadLetterKey(""), fmt.Sprintf(DedupeKeyPrefix, ""),
+		fmt.Sprintf(GlobalDedupeKeyPrefix, ""), NamespaceKeyPrefix, quarantineKey("")}
+
+	var legacy []string
+	err := store.ScanAll(func(key string, value []byte) error {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return nil
+			}
+		}
+		legacy = append(legacy, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range legacy {
+		err := store.Rename(key, itemKey(key))
+		//a legacy key that expired in the meantime has nothing to move
+		if err != nil && err != ErrNotFound {
+			return i, err
+		}
+	}
+
+	if _, err := store.Put(StoreEntry{Key: metaKey(layoutVersionKey), Value: []byte(keyLayoutVersion)}); err != nil {
+		return len(legacy), err
+	}
+	return len(legacy), nil
+}
+
+// MigrateRecords rewrites every queue item and dead letter that was written
+// with an older record version in the current one and returns how many were
+// rewritten. Records keep their expiry. Records that cannot be decoded are
+// left as they are, and invalid queue items are quarantined when loaded.
+//
+// New runs the migration on stores that have not been migrated yet. It is
+// safe to run again if it was interrupted.
+func MigrateRecords(store Store) (int, error) {
+	var outdated []string
+	for _, prefix := range []string{itemKey(""), deadLetterKey("")} {
+		err := store.ScanPrefix(prefix, func(key string, value []byte) error {
+			if len(value) == 0 || value[len(value)-1] != currentRecordVersion {
+				outdated = append(outdated, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	migrated := 0
+	for _, key := range outdated {
+		err := store.Update(key, func(existing []byte) ([]byte, error) {
+			rec, err := decodeRecord(existing)
+			if err != nil {
+				return nil, err
+			}
+			return encodeRecord(rec), nil
+		})
+		switch {
+		case err == nil:
+			migrated++
+		case err != ErrNotFound && !errors.Is(err, ErrInvalidRecord):
+			return migrated, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	if _, err := store.Put(StoreEntry{Key: metaKey(recordVersionKey), Value: []byte{currentRecordVersion}}); err != nil {
+		return migrated, err
+	}
+	return migrated, nil
+}
+
+// migrateStore runs the migrations store has not been through yet.
+func migrateStore(store Store) error {
+	exists, err := store.Exists([]string{metaKey(layoutVersionKey), metaKey(recordVersionKey)})
+	if err != nil {
+		return err
+	}
+	if !exists[0] {
+		if _, err := MigrateKeyLayout(store); err != nil {
+			return err
+		}
+	}
+	if !exists[1] {
+		if _, err := MigrateRecords(store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func itemKey(key string) string {
+	return fmt.Sprintf(ItemKeyPrefix, key)
+}
+
+func metaKey(key string) string {
+	return fmt.Sprintf(MetaKeyPrefix, key)
+}
@@ -0,0 +1,135 @@
+package buffercompact
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MigrateKeyLayout(t *testing.T) {
+	store := NewMemoryStore()
+	past := time.Now().Add(-time.Minute).Unix()
+	store.Put(StoreEntry{Key: "test1", Value: appendScoreBytes([]byte("testValue1"), past)})
+	store.Put(StoreEntry{Key: deadLetterKey("test2"), Value: encodeRecord(record{value: []byte("testValue2")})})
+	store.Put(StoreEntry{Key: "unique_value:test1", Value: []byte("id1")})
+
+	buffcomp, err := NewWithStore(store, 0)
+	assert.Nil(t, err)
+
+	//Only the legacy item is queued, the dedupe marker and dead letter are not
+	assert.Equal(t, 1, buffcomp.sortedSet.GetCount())
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "test1", items[0].Key)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+
+	deadLetters, err := buffcomp.DeadLetters(0)
+	assert.Nil(t, err)
+	assert.Len(t, deadLetters, 1)
+
+	//Migrated stores are not migrated again
+	store.Put(StoreEntry{Key: "test3", Value: appendScoreBytes([]byte("testValue3"), past)})
+	buffcomp, err = NewWithStore(store, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, buffcomp.sortedSet.GetCount())
+}
+
+func Test_PopulateSetFromDB_InvalidRecord(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(StoreEntry{Key: itemKey("test1"), Value: []byte("short")})
+	store.Put(StoreEntry{Key: itemKey("test2"), Value: []byte{9}})
+	store.Put(StoreEntry{Key: itemKey("test3"), Value: encodeRecord(record{value: []byte("testValue3")})})
+
+	quarantined := map[string]error{}
+	onQuarantine := WithOnQuarantine(func(key string, err error) {
+		quarantined[key] = err
+	})
+	buffcomp, err := NewWithStore(store, 0, onQuarantine)
+	assert.Nil(t, err)
+	assert.Len(t, quarantined, 2)
+	assert.True(t, errors.Is(quarantined["test2"], ErrInvalidRecord))
+	assert.Equal(t, 1, buffcomp.sortedSet.GetCount())
+
+	keys, err := buffcomp.Quarantined(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test1", "test2"}, keys)
+
+	//Quarantined records do not fail the next start either
+	quarantined = map[string]error{}
+	_, err = NewWithStore(store, 0, onQuarantine)
+	assert.Nil(t, err)
+	assert.Len(t, quarantined, 0)
+
+	purged, err := buffcomp.PurgeQuarantined()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, purged)
+}
+
+func Test_RetrieveFromQueue_QuarantinesInvalidRecord(test *testing.T) {
+	cases := map[string][]BufferCompactorOption{
+		"Remove": nil,
+		"Lease":  {WithLease(time.Minute)},
+	}
+	for name, opts := range cases {
+		test.Run(name, func(t *testing.T) {
+			store := NewMemoryStore()
+			buffcomp, err := NewWithStore(store, 0, opts...)
+			assert.Nil(t, err)
+
+			buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+			buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+			store.Put(StoreEntry{Key: itemKey("test1"), Value: []byte{9}})
+
+			items, err := buffcomp.RetrieveFromQueue(10)
+			assert.True(t, errors.Is(err, ErrInvalidRecord))
+			assert.Len(t, items, 1)
+			assert.Equal(t, "test2", items[0].Key)
+
+			keys, err := buffcomp.Quarantined(0)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"test1"}, keys)
+			exists, err := store.Exists([]string{itemKey("test1")})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{false}, exists)
+		})
+	}
+}
+
+func Test_MigrateRecords(t *testing.T) {
+	store := NewMemoryStore()
+	legacy := appendScoreBytes([]byte("testValue1"), time.Now().Unix())
+	store.Put(StoreEntry{Key: itemKey("test1"), Value: legacy})
+	store.Put(StoreEntry{Key: metaKey(layoutVersionKey), Value: []byte(keyLayoutVersion)})
+
+	_, err := NewWithStore(store, 0)
+	assert.Nil(t, err)
+
+	var versions []byte
+	store.ScanPrefix(itemKey(""), func(key string, value []byte) error {
+		versions = append(versions, value[len(value)-1])
+		return nil
+	})
+	assert.Equal(t, []byte{currentRecordVersion}, versions)
+
+	migrated, err := MigrateRecords(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
+
+func Test_MigrateKeyLayout_KeepsTTL(t *testing.T) {
+	store := NewMemoryStore()
+	past := time.Now().Add(-time.Minute).Unix()
+	store.Put(StoreEntry{Key: "test1", Value: appendScoreBytes([]byte("testValue1"), past), TTL: 100 * time.Millisecond})
+
+	migrated, err := MigrateKeyLayout(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, migrated)
+
+	time.Sleep(200 * time.Millisecond)
+	exists, err := store.Exists([]string{itemKey("test1")})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false}, exists)
+}
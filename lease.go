@@ -0,0 +1,256 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/parkerroan/buffercompact/sortedset"
+)
+
+var (
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrLeaseMismatch = errors.New("lease token does not match")
+
+	errLeaseReplaced = errors.New("lease replaced")
+)
+
+// leaseValue is the value of the nodes in b.leases.
+type leaseValue struct {
+	size  int64
+	token int64
+}
+
+// WithLease switches retrieval to at-least-once delivery. Items returned by
+// RetrieveFromQueue stay in the store, invisible to other retrievals, until
+// they are acknowledged with Ack. Items that are neither acknowledged nor
+// released with Nack before visibilityTimeout passes are queued again.
+func WithLease(visibilityTimeout time.Duration) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.leaseDuration = visibilityTimeout
+	}
+}
+
+// Ack deletes a leased item from the store. token is the LeaseToken of the
+// retrieved item. ErrLeaseNotFound is returned when key is not leased, either
+// because its lease expired or because a newer write to key replaced it, and
+// ErrLeaseMismatch when key has been leased again since the item was
+// retrieved.
+func (b *BufferCompactor) Ack(key string, token int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkLease(key, token); err != nil {
+		return err
+	}
+	//a write may have replaced the record before it removed the lease
+	err := b.store.DeleteIf(itemKey(key), func(existing []byte) error {
+		rec, err := decodeRecord(existing)
+		if err != nil {
+			return err
+		}
+		return checkLeasedRecord(rec, token)
+	})
+	if err != nil && err != ErrNotFound && err != errLeaseReplaced {
+		return err
+	}
+	b.leases.Remove(key)
+	if err == errLeaseReplaced {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+// Nack ends the lease on key and counts a failed attempt. The item is made
+// available again after the backoff set with WithRetry, or straight away
+// when there is none. Once the attempts allowed by WithRetry are used up the
+// item is moved to the dead-letter keyspace. token and the errors returned
+// are as for Ack.
+func (b *BufferCompactor) Nack(key string, token int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkLease(key, token); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var score, size int64
+	err := b.store.Update(itemKey(key), func(existing []byte) ([]byte, error) {
+		rec, err := decodeRecord(existing)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLeasedRecord(rec, token); err != nil {
+			return nil, err
+		}
+		rec.attempts++
+		if b.maxAttempts > 0 && rec.attempts >= b.maxAttempts {
+			return nil, errAttemptsExhausted
+		}
+
+		score = toScore(now)
+		if b.backoff != nil {
+			score = toScore(now.Add(b.backoff(rec.attempts)))
+		}
+		rec.score = score
+		rec.leased = false
+		size = int64(len(rec.value))
+		return encodeRecord(rec), nil
+	})
+	if err == errAttemptsExhausted {
+		err = b.deadLetter(key, token, now)
+		if err == nil {
+			b.leases.Remove(key)
+			return nil
+		}
+	}
+	if err != nil && err != ErrNotFound && err != errLeaseReplaced {
+		return err
+	}
+
+	b.leases.Remove(key)
+	if err == errLeaseReplaced {
+		return ErrLeaseNotFound
+	}
+	if err == nil {
+		b.enqueue(key, sortedset.SCORE(score), size)
+		b.wakeSubscribers(b.sortedSet, key)
+	}
+	return nil
+}
+
+// checkLease reports whether token is the current lease on key. The caller
+// must hold b.mu.
+func (b *BufferCompactor) checkLease(key string, token int64) error {
+	node := b.leases.GetByKey(key)
+	if node == nil {
+		return ErrLeaseNotFound
+	}
+	if lease, _ := node.Value.(leaseValue); lease.token != token {
+		return ErrLeaseMismatch
+	}
+	return nil
+}
+
+// checkLeasedRecord reports whether rec is still the record leased with
+// token, rather than one written since.
+func checkLeasedRecord(rec record, token int64) error {
+	if !rec.leased || rec.lease != token {
+		return errLeaseReplaced
+	}
+	return nil
+}
+
+// leaseNodes leases the records of nodes taken from the sortedset one at a
+// time. If ctx is done the leased items are returned with its error and the
+// remaining nodes are put back. Keys whose record expired are skipped.
+func (b *BufferCompactor) leaseNodes(ctx context.Context, nodes []*sortedset.SortedSetNode) ([]*StorageItem, error) {
+	response := make([]*StorageItem, 0, len(nodes))
+	var retrieveErr RetrieveError
+	var expired []string
+	defer func() { b.expire(expired) }()
+	for i := range nodes {
+		if err := ctx.Err(); err != nil {
+			b.restoreNodes(nodes[i:])
+			b.settleFailures(&retrieveErr)
+			return response, err
+		}
+
+		item, err := b.leaseFromDB(nodes[i].Key())
+		if err == ErrNotFound {
+			expired = append(expired, nodes[i].Key())
+			continue
+		}
+		if errors.Is(err, ErrInvalidRecord) {
+			if qErr := b.quarantine(nodes[i].Key(), false, nil, err); qErr != nil {
+				err = qErr
+			}
+		}
+		if err != nil {
+			retrieveErr.add(nodes[i], err)
+			continue
+		}
+		response = append(response, item)
+	}
+
+	return response, b.settleFailures(&retrieveErr)
+}
+
+// leaseFromDB marks the record under key as leased until the visibility
+// timeout passes and returns its value. The lease token is the deadline,
+// moved past the record's previous token if needed, so every lease of a key
+// gets a new one.
+func (b *BufferCompactor) leaseFromDB(key string) (*StorageItem, error) {
+	deadline := toScore(time.Now().Add(b.leaseDuration))
+
+	var rec record
+	var token int64
+	err := b.store.Update(itemKey(key), func(existing []byte) ([]byte, error) {
+		var err error
+		if rec, err = decodeRecord(existing); err != nil {
+			return nil, err
+		}
+		token = deadline
+		if token <= rec.lease {
+			token = rec.lease + 1
+		}
+		leased := rec
+		leased.score = deadline
+		leased.lease = token
+		leased.leased = true
+		return encodeRecord(leased), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.leases.AddOrUpdate(key, sortedset.SCORE(deadline), leaseValue{size: int64(len(rec.value)), token: token})
+	b.wakeSubscribers(b.leases, key)
+	b.mu.Unlock()
+
+	item := newStorageItem(key, rec)
+	item.LeaseToken = token
+	item.leaseDeadline = deadline
+	return item, nil
+}
+
+// requeueExpiredLeases moves keys whose lease ran out back into the queue.
+// The caller must hold b.mu.
+func (b *BufferCompactor) requeueExpiredLeases(now time.Time) {
+	expired := b.leases.GetByScoreRange(-1, sortedset.SCORE(toScore(now)), &sortedset.GetByScoreRangeOptions{
+		Remove: true})
+	for _, node := range expired {
+		b.enqueue(node.Key(), node.Score(), nodeSize(node))
+	}
+}
@@ -0,0 +1,184 @@
+package buffercompact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LeaseAckCase(t *testing.T) {
+	store := NewMemoryStore()
+	buffcomp, err := NewWithStore(store, 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+	token := items[0].LeaseToken
+
+	//Leased items are invisible to other retrievals
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+
+	assert.Equal(t, ErrLeaseMismatch, buffcomp.Ack("test1", token+1))
+	assert.Nil(t, buffcomp.Ack("test1", token))
+	assert.Equal(t, ErrLeaseNotFound, buffcomp.Ack("test1", token))
+
+	//Acked items are gone from the store
+	buffcomp2, err := NewWithStore(store, 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+	items, err = buffcomp2.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+}
+
+func Test_LeaseNackCase(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	assert.Nil(t, buffcomp.Nack("test1", items[0].LeaseToken))
+	assert.Equal(t, ErrLeaseNotFound, buffcomp.Nack("test1", items[0].LeaseToken))
+
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+}
+
+func Test_LeaseExpiredCase(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Second))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	time.Sleep(2 * time.Second)
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+}
+
+func Test_LeaseExpiredAck(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(50*time.Millisecond))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	first, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, first, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	second, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, second, 1)
+
+	//the first consumer's lease ran out, so its Ack must not delete the item
+	assert.Equal(t, ErrLeaseMismatch, buffcomp.Ack("test1", first[0].LeaseToken))
+	assert.Nil(t, buffcomp.Nack("test1", second[0].LeaseToken))
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+func Test_LeaseWriteCancelsLease(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2")})
+	assert.Equal(t, ErrLeaseNotFound, buffcomp.Ack("test1", items[0].LeaseToken))
+
+	items, err = buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue2"), items[0].Value)
+}
+
+// hookedPutStore calls afterPut once a Put has been written
+type hookedPutStore struct {
+	*MemoryStore
+	afterPut func()
+}
+
+func (s *hookedPutStore) Put(entry StoreEntry) (bool, error) {
+	stored, err := s.MemoryStore.Put(entry)
+	if s.afterPut != nil {
+		s.afterPut()
+	}
+	return stored, err
+}
+
+func Test_LeaseSettledWhileWriteIsBuffered(t *testing.T) {
+	for name, settle := range map[string]func(b *BufferCompactor, key string, token int64) error{
+		"ack":  (*BufferCompactor).Ack,
+		"nack": (*BufferCompactor).Nack,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := &hookedPutStore{MemoryStore: NewMemoryStore()}
+			buffcomp, err := NewWithStore(store, 0, WithLease(time.Minute), WithRetry(1, nil))
+			assert.Nil(t, err)
+
+			buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+			items, err := buffcomp.RetrieveFromQueue(10)
+			assert.Nil(t, err)
+			assert.Len(t, items, 1)
+
+			//the lease is settled after the new write is stored but before it is buffered
+			store.afterPut = func() {
+				assert.Equal(t, ErrLeaseNotFound, settle(buffcomp, "test1", items[0].LeaseToken))
+			}
+			status, err := buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue2")})
+			assert.Nil(t, err)
+			assert.Equal(t, Stored, status)
+			store.afterPut = nil
+
+			items, err = buffcomp.RetrieveFromQueue(10)
+			assert.Nil(t, err)
+			assert.Len(t, items, 1)
+			assert.Equal(t, []byte("testValue2"), items[0].Value)
+			assert.Equal(t, 0, items[0].Attempts)
+			assert.Equal(t, 0, buffcomp.ExpiredCount())
+		})
+	}
+}
+
+func Test_LeaseSurvivesRestart(t *testing.T) {
+	store := NewMemoryStore()
+	buffcomp, err := NewWithStore(store, 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	//Create new buffer compactor to replicate loading with a leased item
+	buffcomp2, err := NewWithStore(store, 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+
+	token := items[0].LeaseToken
+	items, err = buffcomp2.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+	assert.Nil(t, buffcomp2.Ack("test1", token))
+}
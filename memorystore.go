@@ -0,0 +1,297 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in a map. Nothing survives
+// the process, which makes it a good fit for tests.
+type MemoryStore struct {
+	mu    sync.Mutex
+	items map[string]memoryValue
+}
+
+type memoryValue struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (v memoryValue) expired(now time.Time) bool {
+	return !v.expiresAt.IsZero() && !now.Before(v.expiresAt)
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]memoryValue)}
+}
+
+func (s *MemoryStore) Put(entry StoreEntry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.put(entry, time.Now())
+	if err == ErrDuplicate {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) PutBatch(entries []StoreEntry) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	errs := make([]error, len(entries))
+	for i := range entries {
+		errs[i] = s.put(entries[i], now)
+	}
+	return errs
+}
+
+func (s *MemoryStore) GetAndDelete(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.get(key, time.Now())
+	delete(s.items, key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *MemoryStore) GetAndDeleteBatch(keys []string) ([][]byte, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		value, ok := s.get(key, now)
+		delete(s.items, key)
+		if !ok {
+			errs[i] = ErrNotFound
+			continue
+		}
+		values[i] = value
+	}
+	return values, errs
+}
+
+func (s *MemoryStore) Update(key string, fn func(existing []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.items[key]
+	if !ok || existing.expired(time.Now()) {
+		return ErrNotFound
+	}
+	value, err := fn(existing.value)
+	if err != nil {
+		return err
+	}
+
+	s.items[key] = memoryValue{
+		value:     append([]byte(nil), value...),
+		expiresAt: existing.expiresAt,
+	}
+	return nil
+}
+
+func (s *MemoryStore) Exists(keys []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		_, exists[i] = s.get(key, now)
+	}
+	return exists, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+	return nil
+}
+
+func (s *MemoryStore) DeleteIf(key string, fn func(existing []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.get(key, time.Now())
+	if !ok {
+		return ErrNotFound
+	}
+	if err := fn(existing); err != nil {
+		return err
+	}
+
+	delete(s.items, key)
+	return nil
+}
+
+func (s *MemoryStore) Move(from, to string, fn func(existing []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	existing, ok := s.get(from, now)
+	if !ok {
+		return ErrNotFound
+	}
+	value, err := fn(existing)
+	if err != nil {
+		return err
+	}
+
+	delete(s.items, from)
+	s.set(to, value, 0, now)
+	return nil
+}
+
+func (s *MemoryStore) PutFrom(from string, fn func(existing []byte) (StoreEntry, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	existing, ok := s.get(from, now)
+	if !ok {
+		return ErrNotFound
+	}
+	entry, err := fn(existing)
+	if err != nil {
+		return err
+	}
+
+	//put changes nothing when it fails, so from is only deleted after it
+	if err := s.put(entry, now); err != nil {
+		return err
+	}
+	if entry.Key != from {
+		delete(s.items, from)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Rename(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.items[from]
+	if !ok || existing.expired(time.Now()) {
+		return ErrNotFound
+	}
+	delete(s.items, from)
+	s.items[to] = existing
+	return nil
+}
+
+func (s *MemoryStore) ScanAll(fn func(key string, value []byte) error) error {
+	return s.ScanPrefix("", fn)
+}
+
+// ScanPrefix visits keys in lexical order to match BadgerStore.
+func (s *MemoryStore) ScanPrefix(prefix string, fn func(key string, value []byte) error) error {
+	s.mu.Lock()
+	now := time.Now()
+	keys := make([]string, 0, len(s.items))
+	values := make(map[string][]byte, len(s.items))
+	for k, v := range s.items {
+		if v.expired(now) || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		keys = append(keys, k)
+		values[k] = v.value
+	}
+	s.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) put(entry StoreEntry, now time.Time) error {
+	var marker []byte
+	if entry.UniqueID != "" {
+		existing, _ := s.get(entry.DedupeKey, now)
+		var duplicate bool
+		if marker, duplicate = dedupeMarker(existing, entry.UniqueID, entry.DedupeWindow); duplicate {
+			return ErrDuplicate
+		}
+	}
+
+	value := entry.Value
+	if entry.Merge != nil {
+		if existing, ok := s.get(entry.Key, now); ok {
+			var err error
+			if value, err = entry.Merge(existing); err != nil {
+				return err
+			}
+		}
+	}
+
+	if entry.UniqueID != "" {
+		s.set(entry.DedupeKey, marker, entry.DedupeTTL, now)
+	}
+	s.set(entry.Key, value, entry.TTL, now)
+	return nil
+}
+
+func (s *MemoryStore) get(key string, now time.Time) ([]byte, bool) {
+	v, ok := s.items[key]
+	if !ok || v.expired(now) {
+		return nil, false
+	}
+	return v.value, true
+}
+
+func (s *MemoryStore) set(key string, value []byte, ttl time.Duration, now time.Time) {
+	v := memoryValue{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		v.expiresAt = now.Add(ttl)
+	}
+	s.items[key] = v
+}
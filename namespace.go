@@ -0,0 +1,242 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+var (
+	// NamespaceKeyPrefix starts the keys of every named queue, which are
+	// stored under NamespaceKeyPrefix + name + ":" + key.
+	NamespaceKeyPrefix = "queue:"
+
+	ErrInvalidNamespace = errors.New("invalid namespace")
+)
+
+// queueMetaPrefix is the metadata key under which named queues are recorded
+// in the shared store.
+const queueMetaPrefix = "queue:"
+
+// WithNamespace scopes the queue to name, so that several queues can share
+// one store. Items, dedupe markers, dead letters and metadata of the queue
+// are all kept under the namespace and only its own keys are loaded on
+// startup. name must not be empty or contain ':'.
+func WithNamespace(name string) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.namespace = name
+	}
+}
+
+// Namespace returns the name set with WithNamespace.
+func (b *BufferCompactor) Namespace() string {
+	return b.namespace
+}
+
+// useNamespace records the namespace in store and returns the store the
+// queue should use.
+func useNamespace(store Store, name string) (Store, error) {
+	if name == "" || strings.Contains(name, ":") {
+		return nil, ErrInvalidNamespace
+	}
+
+	if _, err := store.Put(StoreEntry{Key: metaKey(queueMetaPrefix + name), Value: []byte(name)}); err != nil {
+		return nil, err
+	}
+	return &namespacedStore{Store: store, prefix: NamespaceKeyPrefix + name + ":"}, nil
+}
+
+// Registry opens named queues that share a single store.
+type Registry struct {
+	store Store
+
+	mu     sync.Mutex
+	queues map[string]*BufferCompactor
+}
+
+// NewRegistry creates a Registry for queues persisted to the given badger.DB
+func NewRegistry(db *badger.DB) *Registry {
+	return NewRegistryWithStore(NewBadgerStore(db))
+}
+
+// NewRegistryWithStore creates a Registry for queues persisted to any Store
+// implementation
+func NewRegistryWithStore(store Store) *Registry {
+	return &Registry{store: store, queues: make(map[string]*BufferCompactor)}
+}
+
+// Open returns the queue called name, creating it with bufferDuration and
+// opts if it is not open yet.
+func (r *Registry) Open(name string, bufferDuration time.Duration, opts ...BufferCompactorOption) (*BufferCompactor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if queue, ok := r.queues[name]; ok {
+		return queue, nil
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithNamespace(name))
+	queue, err := NewWithStore(r.store, bufferDuration, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r.queues[name] = queue
+	return queue, nil
+}
+
+// OpenAll opens every queue recorded in the store that is not open yet with
+// bufferDuration and opts.
+func (r *Registry) OpenAll(bufferDuration time.Duration, opts ...BufferCompactorOption) error {
+	names, err := r.Names()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, err := r.Open(name, bufferDuration, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the open queue called name, or nil if it is not open.
+func (r *Registry) Get(name string) *BufferCompactor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.queues[name]
+}
+
+// Names lists every queue recorded in the store, open or not, in lexical
+// order.
+func (r *Registry) Names() ([]string, error) {
+	prefix := metaKey(queueMetaPrefix)
+	var names []string
+	err := r.store.ScanPrefix(prefix, func(key string, value []byte) error {
+		names = append(names, strings.TrimPrefix(key, prefix))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// namespacedStore prefixes every key before passing it on to Store.
+type namespacedStore struct {
+	Store
+	prefix string
+}
+
+func (s *namespacedStore) Put(entry StoreEntry) (bool, error) {
+	return s.Store.Put(s.entry(entry))
+}
+
+func (s *namespacedStore) PutBatch(entries []StoreEntry) []error {
+	prefixed := make([]StoreEntry, len(entries))
+	for i := range entries {
+		prefixed[i] = s.entry(entries[i])
+	}
+	return s.Store.PutBatch(prefixed)
+}
+
+func (s *namespacedStore) GetAndDelete(key string) ([]byte, error) {
+	return s.Store.GetAndDelete(s.prefix + key)
+}
+
+func (s *namespacedStore) GetAndDeleteBatch(keys []string) ([][]byte, []error) {
+	return s.Store.GetAndDeleteBatch(s.keys(keys))
+}
+
+func (s *namespacedStore) Update(key string, fn func(existing []byte) ([]byte, error)) error {
+	return s.Store.Update(s.prefix+key, fn)
+}
+
+func (s *namespacedStore) Exists(keys []string) ([]bool, error) {
+	return s.Store.Exists(s.keys(keys))
+}
+
+func (s *namespacedStore) Delete(key string) error {
+	return s.Store.Delete(s.prefix + key)
+}
+
+func (s *namespacedStore) DeleteIf(key string, fn func(existing []byte) error) error {
+	return s.Store.DeleteIf(s.prefix+key, fn)
+}
+
+func (s *namespacedStore) Move(from, to string, fn func(existing []byte) ([]byte, error)) error {
+	return s.Store.Move(s.prefix+from, s.prefix+to, fn)
+}
+
+func (s *namespacedStore) PutFrom(from string, fn func(existing []byte) (StoreEntry, error)) error {
+	return s.Store.PutFrom(s.prefix+from, func(existing []byte) (StoreEntry, error) {
+		entry, err := fn(existing)
+		return s.entry(entry), err
+	})
+}
+
+func (s *namespacedStore) Rename(from, to string) error {
+	return s.Store.Rename(s.prefix+from, s.prefix+to)
+}
+
+func (s *namespacedStore) ScanAll(fn func(key string, value []byte) error) error {
+	return s.ScanPrefix("", fn)
+}
+
+func (s *namespacedStore) ScanPrefix(prefix string, fn func(key string, value []byte) error) error {
+	return s.Store.ScanPrefix(s.prefix+prefix, func(key string, value []byte) error {
+		return fn(strings.TrimPrefix(key, s.prefix), value)
+	})
+}
+
+func (s *namespacedStore) entry(entry StoreEntry) StoreEntry {
+	entry.Key = s.prefix + entry.Key
+	if entry.DedupeKey != "" {
+		entry.DedupeKey = s.prefix + entry.DedupeKey
+	}
+	return entry
+}
+
+func (s *namespacedStore) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+	return prefixed
+}
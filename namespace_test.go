@@ -0,0 +1,50 @@
+package buffercompact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NamespacesShareStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			registry := NewRegistryWithStore(store)
+			orders, err := registry.Open("orders", 0)
+			assert.Nil(t, err)
+			users, err := registry.Open("users", 0)
+			assert.Nil(t, err)
+
+			orders.StoreToQueue(StorageItem{Key: "test1", Value: []byte("order1"), UniqueID: "id1"})
+			users.StoreToQueue(StorageItem{Key: "test1", Value: []byte("user1"), UniqueID: "id1"})
+
+			items, err := orders.RetrieveFromQueue(10)
+			assert.Nil(t, err)
+			assert.Len(t, items, 1)
+			assert.Equal(t, []byte("order1"), items[0].Value)
+
+			names, err := registry.Names()
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"orders", "users"}, names)
+
+			//Reopening only loads each queue's own keys
+			registry = NewRegistryWithStore(store)
+			assert.Nil(t, registry.OpenAll(0))
+			assert.Equal(t, 0, registry.Get("orders").sortedSet.GetCount())
+			items, err = registry.Get("users").RetrieveFromQueue(10)
+			assert.Nil(t, err)
+			assert.Len(t, items, 1)
+			assert.Equal(t, []byte("user1"), items[0].Value)
+
+			//The unnamed queue does not pick up named queues
+			buffcomp, err := NewWithStore(store, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, buffcomp.sortedSet.GetCount())
+		})
+	}
+}
+
+func Test_InvalidNamespace(t *testing.T) {
+	_, err := NewWithStore(NewMemoryStore(), 0, WithNamespace("a:b"))
+	assert.Equal(t, ErrInvalidNamespace, err)
+}
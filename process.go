@@ -0,0 +1,147 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLeaseRequired = errors.New("lease mode required")
+)
+
+// Process runs fn over released items on a pool of workers until ctx is
+// cancelled. An item is acked when fn returns nil and nacked otherwise, so
+// failures are retried according to WithRetry. Items are spread over the
+// workers by key, so releases of the same key are handled one at a time and
+// in order.
+//
+// Keys that fail to be retrieved do not stop Process, as they are queued
+// again or, when their record is invalid, quarantined.
+//
+// Process needs WithLease to be able to retry items. Items that are leased
+// but not yet started when ctx is cancelled are retried once their lease
+// expires. If fn outlasts the lease on an item and the item is leased again
+// before fn returns, Process stops with an error wrapping ErrLeaseMismatch.
+func (b *BufferCompactor) Process(ctx context.Context, workers int, fn func(context.Context, *StorageItem) error) error {
+	if b.leaseDuration <= 0 {
+		return ErrLeaseRequired
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failOnce sync.Once
+	var failErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failErr = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	queues := make([]chan *StorageItem, workers)
+	for i := range queues {
+		queues[i] = make(chan *StorageItem)
+		wg.Add(1)
+		go func(queue <-chan *StorageItem) {
+			defer wg.Done()
+			for item := range queue {
+				if err := b.settle(item, fn(ctx, item)); err != nil {
+					fail(err)
+				}
+			}
+		}(queues[i])
+	}
+
+	err := b.Subscribe(ctx, func(ctx context.Context, items []*StorageItem) {
+		for _, item := range items {
+			select {
+			case queues[keyShard(item.Key, workers)] <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}, &SubscribeOptions{BatchSize: workers, OnError: func(err error) {
+		//the keys of a RetrieveError are queued again or quarantined, so
+		//only errors that are not about single keys stop the workers
+		var retrieveErr *RetrieveError
+		if !errors.As(err, &retrieveErr) {
+			fail(err)
+		}
+	}})
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	if failErr != nil {
+		return failErr
+	}
+	return err
+}
+
+// settle acks item when processing succeeded and nacks it otherwise. A lease
+// that was ended by a newer write, or that ran out and is queued again, is
+// not an error, but one that ran out and was taken over by another retrieval
+// is.
+func (b *BufferCompactor) settle(item *StorageItem, processErr error) error {
+	var err error
+	if processErr == nil {
+		err = b.Ack(item.Key, item.LeaseToken)
+	} else {
+		err = b.Nack(item.Key, item.LeaseToken)
+	}
+
+	//before the deadline only a newer write can have replaced the lease
+	if err == ErrLeaseNotFound || (err == ErrLeaseMismatch && time.Now().Before(fromScore(item.leaseDeadline))) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", item.Key, err)
+	}
+	return nil
+}
+
+func keyShard(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
@@ -0,0 +1,139 @@
+package buffercompact
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ProcessRequiresLease(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0)
+	assert.Nil(t, err)
+
+	err = buffcomp.Process(context.Background(), 2, func(ctx context.Context, item *StorageItem) error {
+		return nil
+	})
+	assert.Equal(t, ErrLeaseRequired, err)
+}
+
+func Test_ProcessCase(t *testing.T) {
+	noBackoff := func(int) time.Duration { return 0 }
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(time.Minute), WithRetry(0, noBackoff))
+	assert.Nil(t, err)
+
+	var mu sync.Mutex
+	running := map[string]bool{}
+	processed := map[string]int{}
+	failed := false
+	overlap := false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- buffcomp.Process(ctx, 4, func(ctx context.Context, item *StorageItem) error {
+			mu.Lock()
+			if running[item.Key] {
+				overlap = true
+			}
+			running[item.Key] = true
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			running[item.Key] = false
+			//fail the first attempt of test1 to have it retried
+			if item.Key == "test1" && !failed {
+				failed = true
+				return errors.New("processing failed")
+			}
+			processed[item.Key]++
+			return nil
+		})
+	}()
+
+	for i := 0; i < 3; i++ {
+		buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+		buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+		buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.False(t, overlap)
+	assert.True(t, failed)
+	for _, key := range []string{"test1", "test2", "test3"} {
+		assert.GreaterOrEqual(t, processed[key], 1, key)
+	}
+
+	//Everything was acked
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+	assert.Equal(t, 0, buffcomp.leases.GetCount())
+}
+
+func Test_ProcessLeaseTakenOver(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0, WithLease(50*time.Millisecond))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	//the lease runs out and the item is leased again before fn returns
+	err = buffcomp.Process(context.Background(), 1, func(ctx context.Context, item *StorageItem) error {
+		time.Sleep(150 * time.Millisecond)
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrLeaseMismatch))
+
+	//the item was not acked by the stale lease
+	time.Sleep(100 * time.Millisecond)
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+func Test_ProcessSkipsFailedKeys(t *testing.T) {
+	store := NewMemoryStore()
+	buffcomp, err := NewWithStore(store, 0, WithLease(time.Minute))
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	store.Put(StoreEntry{Key: itemKey("test1"), Value: []byte{9}})
+
+	processed := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- buffcomp.Process(ctx, 2, func(ctx context.Context, item *StorageItem) error {
+			processed <- item.Key
+			return nil
+		})
+	}()
+
+	//the quarantined record does not stop the workers
+	time.Sleep(50 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+	select {
+	case key := <-processed:
+		assert.Equal(t, "test2", key)
+	case <-time.After(time.Second):
+		t.Fatal("item was not processed")
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	keys, err := buffcomp.Quarantined(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test1"}, keys)
+}
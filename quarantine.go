@@ -0,0 +1,113 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	QuarantineKeyPrefix = "quarantine:%s"
+)
+
+// WithOnQuarantine calls fn with every key whose record could not be decoded,
+// along with the decoding error, once the record has been moved to the
+// quarantine keyspace. Such records are quarantined when they are loaded or
+// retrieved, so they neither stop New nor get released. fn is called without
+// any locks held.
+func WithOnQuarantine(fn func(key string, err error)) BufferCompactorOption {
+	return func(b *BufferCompactor) {
+		b.onQuarantine = fn
+	}
+}
+
+// Quarantined returns up to limit keys from the quarantine keyspace, or all
+// of them when limit is zero, without the quarantine prefix.
+func (b *BufferCompactor) Quarantined(limit int) ([]string, error) {
+	var keys []string
+	prefix := quarantineKey("")
+	err := b.store.ScanPrefix(prefix, func(key string, value []byte) error {
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+		if limit > 0 && len(keys) >= limit {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// PurgeQuarantined deletes every quarantined record and returns how many
+// were removed.
+func (b *BufferCompactor) PurgeQuarantined() (int, error) {
+	var keys []string
+	err := b.store.ScanPrefix(quarantineKey(""), func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := b.store.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// quarantine moves the invalid record of key out of the item keyspace. When
+// removed is set the record was already taken out of the store and value is
+// written to the quarantine keyspace instead.
+func (b *BufferCompactor) quarantine(key string, removed bool, value []byte, decodeErr error) error {
+	var err error
+	if removed {
+		_, err = b.store.Put(StoreEntry{Key: quarantineKey(key), Value: value})
+	} else {
+		err = b.store.Rename(itemKey(key), quarantineKey(key))
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if b.onQuarantine != nil {
+		b.onQuarantine(key, decodeErr)
+	}
+	return nil
+}
+
+func quarantineKey(key string) string {
+	return fmt.Sprintf(QuarantineKeyPrefix, key)
+}
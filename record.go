@@ -0,0 +1,249 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrInvalidRecord = errors.New("invalid record")
+)
+
+// Values written before records were versioned are the payload followed by
+// the 8 byte score from appendScoreBytes, in unix seconds. The score of those
+// records is a positive unix time, so their last byte is always zero, which
+// leaves any non-zero trailing byte free to carry a record version:
+//
+//	v1: payload | meta | meta length (4) | 0x01
+//
+// The v1 meta holds, in order:
+//
+//	score (8) | first seen (8) | last update (8) | writes (4) | attempts (4) |
+//	lease (8) | flags (1) | unique id | header count (uvarint) | headers
+//
+// where times are unix milliseconds and the unique id and every header key
+// and value are a uvarint length followed by that many bytes. Headers are
+// written sorted by key.
+const (
+	recordVersion1 byte = 1
+
+	currentRecordVersion = recordVersion1
+)
+
+const (
+	recordFlagLeased byte = 1 << iota
+)
+
+// recordMetaFixedSize is the size of the fixed width fields of the meta.
+const recordMetaFixedSize = 8 + 8 + 8 + 4 + 4 + 8 + 1
+
+// record is the decoded form of a value held in the Store.
+type record struct {
+	value      []byte
+	score      int64
+	firstSeen  int64 // score of the first write since the key was last released
+	lastUpdate int64 // score of the latest write
+	writes     int   // writes compacted into the record since it was last released
+	uniqueID   string
+	attempts   int
+	lease      int64 // token of the latest lease, see leaseFromDB
+	leased     bool
+	headers    map[string][]byte
+}
+
+// status reports whether the write that produced r was compacted into a
+// record that was still buffered.
+func (r record) status() StoreStatus {
+	if r.writes > 1 {
+		return Compacted
+	}
+	return Stored
+}
+
+func encodeRecord(r record) []byte {
+	var flags byte
+	if r.leased {
+		flags |= recordFlagLeased
+	}
+
+	b := make([]byte, len(r.value), len(r.value)+recordMetaFixedSize+len(r.uniqueID)+16)
+	copy(b, r.value)
+	b = appendUint64(b, uint64(r.score))
+	b = appendUint64(b, uint64(r.firstSeen))
+	b = appendUint64(b, uint64(r.lastUpdate))
+	b = appendUint32(b, uint32(r.writes))
+	b = appendUint32(b, uint32(r.attempts))
+	b = appendUint64(b, uint64(r.lease))
+	b = append(b, flags)
+	b = appendString(b, r.uniqueID)
+
+	keys := make([]string, 0, len(r.headers))
+	for k := range r.headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, string(r.headers[k]))
+	}
+
+	b = appendUint32(b, uint32(len(b)-len(r.value)))
+	return append(b, currentRecordVersion)
+}
+
+func decodeRecord(b []byte) (record, error) {
+	if len(b) == 0 {
+		return record{}, fmt.Errorf("%w: empty value", ErrInvalidRecord)
+	}
+
+	version := b[len(b)-1]
+	switch version {
+	case recordVersion1:
+		return decodeRecordV1(b)
+	case 0:
+		return decodeLegacyRecord(b)
+	default:
+		return record{}, fmt.Errorf("%w: unknown version %d", ErrInvalidRecord, version)
+	}
+}
+
+func decodeRecordV1(b []byte) (record, error) {
+	var r record
+	if len(b) < 5 {
+		return r, fmt.Errorf("%w: truncated v1 record", ErrInvalidRecord)
+	}
+	metaLen := int(binary.LittleEndian.Uint32(b[len(b)-5:]))
+	if metaLen < recordMetaFixedSize || metaLen > len(b)-5 {
+		return r, fmt.Errorf("%w: bad v1 meta length %d", ErrInvalidRecord, metaLen)
+	}
+	end := len(b) - 5
+	r.value = b[:end-metaLen]
+	meta := b[end-metaLen : end]
+
+	r.score = int64(binary.LittleEndian.Uint64(meta))
+	r.firstSeen = int64(binary.LittleEndian.Uint64(meta[8:]))
+	r.lastUpdate = int64(binary.LittleEndian.Uint64(meta[16:]))
+	r.writes = int(binary.LittleEndian.Uint32(meta[24:]))
+	r.attempts = int(binary.LittleEndian.Uint32(meta[28:]))
+	r.lease = int64(binary.LittleEndian.Uint64(meta[32:]))
+	r.leased = meta[40]&recordFlagLeased != 0
+	meta = meta[recordMetaFixedSize:]
+
+	var ok bool
+	if r.uniqueID, meta, ok = readString(meta); !ok {
+		return record{}, fmt.Errorf("%w: bad v1 unique id", ErrInvalidRecord)
+	}
+	count, n := binary.Uvarint(meta)
+	if n <= 0 || count > uint64(len(meta)) {
+		return record{}, fmt.Errorf("%w: bad v1 header count", ErrInvalidRecord)
+	}
+	meta = meta[n:]
+	if count > 0 {
+		r.headers = make(map[string][]byte, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		var k, v string
+		if k, meta, ok = readString(meta); !ok {
+			return record{}, fmt.Errorf("%w: bad v1 header", ErrInvalidRecord)
+		}
+		if v, meta, ok = readString(meta); !ok {
+			return record{}, fmt.Errorf("%w: bad v1 header", ErrInvalidRecord)
+		}
+		r.headers[k] = []byte(v)
+	}
+	return r, nil
+}
+
+// decodeLegacyRecord decodes values written before records were versioned.
+func decodeLegacyRecord(b []byte) (record, error) {
+	var r record
+	if len(b) < 8 {
+		return r, fmt.Errorf("%w: value shorter than its score", ErrInvalidRecord)
+	}
+	r.score, r.value = removeScoreBytes(b)
+	r.score *= millisPerSecond
+	return r, nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 || length > uint64(len(b)-n) {
+		return "", nil, false
+	}
+	b = b[n:]
+	return string(b[:length]), b[length:], true
+}
+
+const millisPerSecond = int64(time.Second / time.Millisecond)
+
+// toScore converts t to a sortedset score, in unix milliseconds.
+func toScore(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+func fromScore(score int64) time.Time {
+	return time.UnixMilli(score)
+}
+
+// scoreTime is fromScore that maps the zero score to the zero time.
+func scoreTime(score int64) time.Time {
+	if score == 0 {
+		return time.Time{}
+	}
+	return fromScore(score)
+}
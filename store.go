@@ -0,0 +1,166 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("key not found")
+	ErrDuplicate = errors.New("duplicate unique id")
+)
+
+// Store is the persistence layer behind a BufferCompactor. Implementations
+// must be safe for concurrent use.
+type Store interface {
+	// Put atomically writes entry. When entry.UniqueID is set and the marker
+	// stored under entry.DedupeKey already holds the same id, nothing is
+	// written and Put returns false. Otherwise the id is added to the marker,
+	// see dedupeMarker.
+	Put(entry StoreEntry) (bool, error)
+
+	// PutBatch applies Put to every entry using as few transactions as
+	// possible. The result holds an error for each entry: nil when it was
+	// stored, ErrDuplicate when it was skipped for dedupe, or the error that
+	// kept it from being written.
+	PutBatch(entries []StoreEntry) []error
+
+	// GetAndDelete atomically reads and removes the value stored under key.
+	// ErrNotFound is returned when the key does not exist or has expired.
+	GetAndDelete(key string) ([]byte, error)
+
+	// GetAndDeleteBatch applies GetAndDelete to every key using as few
+	// transactions as possible. For keys[i] either values[i] holds the value
+	// that was removed or errs[i] says why nothing was.
+	GetAndDeleteBatch(keys []string) (values [][]byte, errs []error)
+
+	// Update atomically replaces the value stored under key with the result
+	// of fn, keeping its expiry. ErrNotFound is returned when the key does
+	// not exist or has expired.
+	Update(key string, fn func(existing []byte) ([]byte, error)) error
+
+	// Exists reports for every key whether it holds a value that has not
+	// expired.
+	Exists(keys []string) ([]bool, error)
+
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+
+	// DeleteIf atomically removes key when fn, called with the value stored
+	// under it, returns nil. An error from fn leaves key in place and is
+	// passed back. ErrNotFound is returned when key does not exist or has
+	// expired.
+	DeleteIf(key string, fn func(existing []byte) error) error
+
+	// Move atomically deletes from and writes the result of fn, called with
+	// the value stored under from, to the key to. The new value does not
+	// expire. ErrNotFound is returned when from does not exist or has expired.
+	Move(from, to string, fn func(existing []byte) ([]byte, error)) error
+
+	// PutFrom atomically deletes from and applies Put to the entry fn builds
+	// from the value stored under from. Nothing is changed when fn or the Put
+	// fail, and ErrDuplicate is returned when the Put is skipped for dedupe.
+	// ErrNotFound is returned when from does not exist or has expired.
+	PutFrom(from string, fn func(existing []byte) (StoreEntry, error)) error
+
+	// Rename atomically moves the value stored under from to the key to,
+	// keeping its expiry. ErrNotFound is returned when from does not exist
+	// or has expired.
+	Rename(from, to string) error
+
+	// ScanAll calls fn for every live key in the store. Returning an error
+	// from fn stops the scan and is passed back to the caller.
+	ScanAll(fn func(key string, value []byte) error) error
+
+	// ScanPrefix is ScanAll limited to keys starting with prefix.
+	ScanPrefix(prefix string, fn func(key string, value []byte) error) error
+}
+
+// StoreEntry is a single write passed to Store.Put.
+type StoreEntry struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration // zero means the value never expires
+
+	// Merge, when set, is called inside the write transaction with the value
+	// currently stored under Key and returns the value to write instead.
+	// It is not called when Key does not exist yet.
+	Merge func(existing []byte) ([]byte, error)
+
+	DedupeKey    string
+	UniqueID     string
+	DedupeTTL    time.Duration // zero means the marker never expires
+	DedupeWindow int           // how many ids the marker keeps, at least one
+}
+
+// dedupeListPrefix starts markers that hold more than one id. Markers that
+// hold a single id are the raw id.
+const dedupeListPrefix byte = 0
+
+// dedupeMarker checks id against the marker existing, which holds up to
+// window of the latest ids. It returns whether id is a duplicate and, if it
+// is not, the marker to store with id added and the oldest ids dropped.
+func dedupeMarker(existing []byte, id string, window int) ([]byte, bool) {
+	var ids []string
+	if len(existing) > 0 && existing[0] == dedupeListPrefix {
+		b := existing[1:]
+		for len(b) > 0 {
+			var s string
+			var ok bool
+			if s, b, ok = readString(b); !ok {
+				break
+			}
+			ids = append(ids, s)
+		}
+	} else if existing != nil {
+		ids = []string{string(existing)}
+	}
+
+	for _, existingID := range ids {
+		if existingID == id {
+			return nil, true
+		}
+	}
+
+	if window <= 1 {
+		return []byte(id), false
+	}
+	ids = append(ids, id)
+	if len(ids) > window {
+		ids = ids[len(ids)-window:]
+	}
+	marker := []byte{dedupeListPrefix}
+	for _, s := range ids {
+		marker = appendString(marker, s)
+	}
+	return marker, false
+}
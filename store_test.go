@@ -0,0 +1,208 @@
+package buffercompact
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return map[string]Store{
+		"Badger": NewBadgerStore(db),
+		"Memory": NewMemoryStore(),
+	}
+}
+
+func Test_Store(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			stored, err := store.Put(StoreEntry{Key: "test1", Value: []byte("value1"), DedupeKey: "dedupe:test1", UniqueID: "id1"})
+			assert.Nil(t, err)
+			assert.True(t, stored)
+
+			stored, err = store.Put(StoreEntry{Key: "test1", Value: []byte("value2"), DedupeKey: "dedupe:test1", UniqueID: "id1"})
+			assert.Nil(t, err)
+			assert.False(t, stored)
+
+			stored, err = store.Put(StoreEntry{Key: "test2", Value: []byte("value3")})
+			assert.Nil(t, err)
+			assert.True(t, stored)
+
+			var keys []string
+			err = store.ScanAll(func(key string, value []byte) error {
+				keys = append(keys, key)
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"dedupe:test1", "test1", "test2"}, keys)
+
+			value, err := store.GetAndDelete("test1")
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value1"), value)
+
+			_, err = store.GetAndDelete("test1")
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func Test_Store_TTL(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			_, err := store.Put(StoreEntry{Key: "test1", Value: []byte("value1"), TTL: time.Second})
+			assert.Nil(t, err)
+
+			exists, err := store.Exists([]string{"test1", "missing"})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{true, false}, exists)
+
+			time.Sleep(1500 * time.Millisecond)
+
+			exists, err = store.Exists([]string{"test1"})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{false}, exists)
+
+			_, err = store.GetAndDelete("test1")
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func Test_Store_Merge(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			merge := func(existing []byte) ([]byte, error) {
+				return append(existing, []byte("+new")...), nil
+			}
+
+			_, err := store.Put(StoreEntry{Key: "test1", Value: []byte("first"), Merge: merge})
+			assert.Nil(t, err)
+			_, err = store.Put(StoreEntry{Key: "test1", Value: []byte("ignored"), Merge: merge})
+			assert.Nil(t, err)
+
+			value, err := store.GetAndDelete("test1")
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("first+new"), value)
+		})
+	}
+}
+
+func Test_Store_MoveAndScanPrefix(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			store.Put(StoreEntry{Key: "queue:test1", Value: []byte("value1")})
+			store.Put(StoreEntry{Key: "queue:test2", Value: []byte("value2")})
+
+			err := store.Move("queue:test1", "dead:test1", func(existing []byte) ([]byte, error) {
+				return append(existing, []byte("+dead")...), nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, ErrNotFound, store.Move("queue:test1", "dead:test1", nil))
+
+			values := map[string]string{}
+			err = store.ScanPrefix("dead:", func(key string, value []byte) error {
+				values[key] = string(value)
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, map[string]string{"dead:test1": "value1+dead"}, values)
+		})
+	}
+}
+
+func Test_Store_GetAndDeleteBatch(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			store.Put(StoreEntry{Key: "test1", Value: []byte("value1")})
+			store.Put(StoreEntry{Key: "test2", Value: []byte("value2")})
+
+			values, errs := store.GetAndDeleteBatch([]string{"test1", "missing", "test2"})
+			assert.Equal(t, [][]byte{[]byte("value1"), nil, []byte("value2")}, values)
+			assert.Equal(t, []error{nil, ErrNotFound, nil}, errs)
+
+			_, err := store.GetAndDelete("test2")
+			assert.Equal(t, ErrNotFound, err)
+		})
+	}
+}
+
+func Test_Store_Rename(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			store.Put(StoreEntry{Key: "test1", Value: []byte("value1"), TTL: time.Second})
+			store.Put(StoreEntry{Key: "test2", Value: []byte("value2")})
+
+			assert.Nil(t, store.Rename("test1", "item:test1"))
+			assert.Nil(t, store.Rename("test2", "item:test2"))
+			assert.Equal(t, ErrNotFound, store.Rename("test1", "item:test1"))
+
+			exists, err := store.Exists([]string{"test1", "item:test1", "item:test2"})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{false, true, true}, exists)
+
+			//the renamed value keeps its expiry
+			time.Sleep(1500 * time.Millisecond)
+			exists, err = store.Exists([]string{"item:test1", "item:test2"})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{false, true}, exists)
+		})
+	}
+}
+
+func Test_Store_DeleteIf(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			store.Put(StoreEntry{Key: "test1", Value: []byte("value1")})
+
+			keep := errors.New("keep")
+			assert.Equal(t, keep, store.DeleteIf("test1", func(existing []byte) error {
+				assert.Equal(t, []byte("value1"), existing)
+				return keep
+			}))
+			exists, err := store.Exists([]string{"test1"})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{true}, exists)
+
+			assert.Nil(t, store.DeleteIf("test1", func(existing []byte) error { return nil }))
+			assert.Equal(t, ErrNotFound, store.DeleteIf("test1", func(existing []byte) error { return nil }))
+			exists, err = store.Exists([]string{"test1"})
+			assert.Nil(t, err)
+			assert.Equal(t, []bool{false}, exists)
+		})
+	}
+}
+
+func Test_Store_PutFrom(test *testing.T) {
+	for name, store := range testStores(test) {
+		test.Run(name, func(t *testing.T) {
+			store.Put(StoreEntry{Key: "from", Value: []byte("value1")})
+			store.Put(StoreEntry{Key: "to", Value: []byte("value2")})
+
+			failed := errors.New("failed")
+			assert.Equal(t, failed, store.PutFrom("from", func(existing []byte) (StoreEntry, error) {
+				return StoreEntry{}, failed
+			}))
+			assert.Nil(t, store.PutFrom("from", func(existing []byte) (StoreEntry, error) {
+				return StoreEntry{Key: "to", Value: existing, Merge: func(old []byte) ([]byte, error) {
+					return append(append([]byte(nil), old...), existing...), nil
+				}}, nil
+			}))
+			assert.Equal(t, ErrNotFound, store.PutFrom("from", func(existing []byte) (StoreEntry, error) {
+				return StoreEntry{Key: "to", Value: existing}, nil
+			}))
+
+			value, err := store.GetAndDelete("to")
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value2value1"), value)
+		})
+	}
+}
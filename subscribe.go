@@ -0,0 +1,196 @@
+// BSD 3-Clause License
+
+// Copyright (c) 2022, Parker Roan
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package buffercompact
+
+import (
+	"context"
+	"time"
+
+	"github.com/parkerroan/buffercompact/sortedset"
+)
+
+const defaultSubscribeBatchSize = 100
+
+type SubscribeOptions struct {
+	BatchSize int           // max items per delivery, defaults to 100
+	Linger    time.Duration // how long to wait for a batch to fill once its first item is due
+	OnError   func(error)   // called with retrieval errors; when nil Subscribe returns them
+}
+
+// Subscribe delivers released items to handler in batches until ctx is
+// cancelled. Instead of polling, it sleeps until the next item is due and is
+// woken early when an item that is due sooner is stored.
+//
+// Items handed to handler are removed from the queue, unless WithLease is
+// used, in which case handler is responsible for calling Ack or Nack.
+//
+// If options is nil, the defaults are used.
+func (b *BufferCompactor) Subscribe(ctx context.Context, handler func(context.Context, []*StorageItem), options *SubscribeOptions) error {
+	var opts SubscribeOptions
+	if options != nil {
+		opts = *options
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultSubscribeBatchSize
+	}
+
+	for {
+		batch, err := b.nextBatch(ctx, opts)
+		//anything already retrieved is delivered, even when stopping
+		if len(batch) > 0 {
+			handler(ctx, batch)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if opts.OnError == nil {
+				return err
+			}
+			opts.OnError(err)
+		}
+	}
+}
+
+// SubscribeChan is Subscribe delivering batches on a channel, which is closed
+// once ctx is cancelled or retrieval fails. The error that stopped the
+// subscription is then sent on the second channel, which is closed after it.
+// A batch that is still pending when ctx is cancelled is put back into the
+// queue, or with WithLease left to its lease running out.
+func (b *BufferCompactor) SubscribeChan(ctx context.Context, options *SubscribeOptions) (<-chan []*StorageItem, <-chan error) {
+	ch := make(chan []*StorageItem)
+	errs := make(chan error, 1)
+	go func() {
+		var restoreErr error
+		err := b.Subscribe(ctx, func(ctx context.Context, items []*StorageItem) {
+			select {
+			case ch <- items:
+			case <-ctx.Done():
+				//the items are already gone from the store unless leased
+				if b.leaseDuration == 0 {
+					if err := b.restoreItems(items); err != nil && restoreErr == nil {
+						restoreErr = err
+					}
+				}
+			}
+		}, options)
+		if restoreErr != nil {
+			err = restoreErr
+		}
+		close(ch)
+		errs <- err
+		close(errs)
+	}()
+	return ch, errs
+}
+
+// nextBatch blocks until at least one item is released and then collects up
+// to opts.BatchSize items for at most opts.Linger.
+func (b *BufferCompactor) nextBatch(ctx context.Context, opts SubscribeOptions) ([]*StorageItem, error) {
+	var batch []*StorageItem
+	var linger <-chan time.Time
+
+	for {
+		items, err := b.RetrieveFromQueueCtx(ctx, opts.BatchSize-len(batch))
+		batch = append(batch, items...)
+		if err != nil {
+			return batch, err
+		}
+		if len(batch) > 0 && (len(batch) >= opts.BatchSize || opts.Linger <= 0) {
+			return batch, nil
+		}
+		if len(batch) > 0 && linger == nil {
+			lingerTimer := time.NewTimer(opts.Linger)
+			defer lingerTimer.Stop()
+			linger = lingerTimer.C
+		}
+
+		wait, changed := b.nextDue()
+		var due <-chan time.Time
+		var dueTimer *time.Timer
+		if wait >= 0 {
+			dueTimer = time.NewTimer(wait)
+			due = dueTimer.C
+		}
+
+		var done bool
+		select {
+		case <-ctx.Done():
+			err, done = ctx.Err(), true
+		case <-linger:
+			done = true
+		case <-changed:
+		case <-due:
+		}
+		if dueTimer != nil {
+			dueTimer.Stop()
+		}
+		if done {
+			return batch, err
+		}
+	}
+}
+
+// nextDue returns how long until the next item can be retrieved, or -1 when
+// nothing is buffered, along with a channel that is closed when that changes.
+func (b *BufferCompactor) nextDue() (time.Duration, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.full() {
+		return 0, b.changed
+	}
+
+	next := sortedset.SCORE(-1)
+	for _, set := range []*sortedset.SortedSet{b.sortedSet, b.leases} {
+		if node := set.PeekMin(); node != nil && (next < 0 || node.Score() < next) {
+			next = node.Score()
+		}
+	}
+	if next < 0 {
+		return -1, b.changed
+	}
+
+	wait := time.Until(fromScore(int64(next)))
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, b.changed
+}
+
+// wakeSubscribers is called after key is added to set and wakes up waiting
+// subscribers if key is now the first one due or the queue is full. The
+// caller must hold b.mu.
+func (b *BufferCompactor) wakeSubscribers(set *sortedset.SortedSet, key string) {
+	if node := set.PeekMin(); b.full() || (node != nil && node.Key() == key) {
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
@@ -0,0 +1,148 @@
+package buffercompact
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SubscribeWakesForEarlierItem(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := make(chan []*StorageItem, 10)
+	go buffcomp.Subscribe(ctx, func(ctx context.Context, items []*StorageItem) {
+		batches <- items
+	}, nil)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "later", Value: []byte("testValue1")})
+	time.Sleep(50 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "now", Value: []byte("testValue2"), Delay: 100 * time.Millisecond})
+
+	select {
+	case items := <-batches:
+		assert.Len(t, items, 1)
+		assert.Equal(t, "now", items[0].Key)
+	case <-time.After(time.Second):
+		t.Fatal("item was not delivered")
+	}
+}
+
+func Test_SubscribeBatching(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := make(chan []*StorageItem, 10)
+	go buffcomp.Subscribe(ctx, func(ctx context.Context, items []*StorageItem) {
+		batches <- items
+	}, &SubscribeOptions{BatchSize: 3, Linger: 300 * time.Millisecond})
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	time.Sleep(50 * time.Millisecond)
+	buffcomp.StoreToQueue(StorageItem{Key: "test2", Value: []byte("testValue2")})
+
+	//Lingers for the batch to fill, then delivers what it has
+	select {
+	case items := <-batches:
+		assert.Len(t, items, 2)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not delivered")
+	}
+
+	//A full batch is delivered without waiting out the linger
+	buffcomp.StoreToQueue(StorageItem{Key: "test3", Value: []byte("testValue3")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test4", Value: []byte("testValue4")})
+	buffcomp.StoreToQueue(StorageItem{Key: "test5", Value: []byte("testValue5")})
+	select {
+	case items := <-batches:
+		assert.Len(t, items, 3)
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("full batch was not delivered")
+	}
+}
+
+func Test_SubscribeCancel(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), time.Hour)
+	assert.Nil(t, err)
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- buffcomp.Subscribe(ctx, func(ctx context.Context, items []*StorageItem) {}, nil)
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("subscribe did not stop")
+	}
+}
+
+func Test_SubscribeChan(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 100*time.Millisecond)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, errs := buffcomp.SubscribeChan(ctx, nil)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	select {
+	case items := <-ch:
+		assert.Len(t, items, 1)
+		assert.Equal(t, []byte("testValue1"), items[0].Value)
+	case <-time.After(time.Second):
+		t.Fatal("item was not delivered")
+	}
+
+	cancel()
+	_, open := <-ch
+	assert.False(t, open)
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func Test_SubscribeChan_RetrieveError(t *testing.T) {
+	store := &failingStore{MemoryStore: NewMemoryStore(), failKeys: map[string]bool{itemKey("test1"): true}}
+	buffcomp, err := NewWithStore(store, 0)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1")})
+	ch, errs := buffcomp.SubscribeChan(context.Background(), nil)
+
+	_, open := <-ch
+	assert.False(t, open)
+	var retrieveErr *RetrieveError
+	assert.True(t, errors.As(<-errs, &retrieveErr))
+	assert.Equal(t, []string{"test1"}, retrieveErr.Keys)
+}
+
+func Test_SubscribeChan_CancelKeepsPendingBatch(t *testing.T) {
+	buffcomp, err := NewWithStore(NewMemoryStore(), 0)
+	assert.Nil(t, err)
+
+	buffcomp.StoreToQueue(StorageItem{Key: "test1", Value: []byte("testValue1"), Headers: map[string][]byte{"h": []byte("v")}})
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, errs := buffcomp.SubscribeChan(ctx, &SubscribeOptions{BatchSize: 10, Linger: time.Second})
+
+	//the batch is retrieved but cancelled before anyone takes it
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	_, open := <-ch
+	assert.False(t, open)
+
+	items, err := buffcomp.RetrieveFromQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, []byte("testValue1"), items[0].Value)
+	assert.Equal(t, []byte("v"), items[0].Headers["h"])
+}